@@ -0,0 +1,241 @@
+package posix_mq
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ChunkMagic starts every fragment sent by a ChunkedQueue.
+var ChunkMagic = [4]byte{0x89, 'P', 'M', 'C'}
+
+const (
+	ChunkVersion = 1
+
+	// chunkHeaderLen is the size of the header of a fragment:
+	// magic, version, message ID, fragment index, fragment count and payload size, the integers being big-endian.
+	chunkHeaderLen = 4 + 1 + 16 + 4 + 4 + 8
+
+	DefaultChunkMaxSize    = 64 << 20
+	DefaultChunkMaxPending = 64 << 20
+	DefaultChunkTimeout    = 30 * time.Second
+)
+
+// ChunkConfig is used to configure a ChunkedQueue, zero values meaning the defaults.
+type ChunkConfig struct {
+	MaxSize    int           // Max. size of a payload, larger ones are dropped as their fragments arrive
+	MaxPending int           // Max. bytes held for incomplete payloads, the oldest ones are dropped beyond
+	Timeout    time.Duration // Time after which an incomplete payload is dropped
+}
+
+// ChunkedQueue sends payloads larger than the msgsize of a MessageQueue by splitting them into fragments,
+// which it reassembles on receipt. The fragments of the payloads of several producers may interleave.
+//
+// Fragments are sent one after the other, so on a non-blocking queue a full queue can interrupt a payload
+// midway: its fragments already sent are dropped by the receiver once Timeout passes. Messages received
+// without fragment header are returned as they are.
+// A ChunkedQueue is safe for concurrent use by multiple goroutines.
+type ChunkedQueue struct {
+	mq     *MessageQueue
+	config ChunkConfig
+
+	mu           sync.Mutex
+	pending      map[[16]byte]*partialPayload
+	pendingBytes int
+	discarded    map[[16]byte]time.Time // payloads dropped while their fragments may still arrive
+	dropped      atomic.Uint64
+}
+
+type partialPayload struct {
+	data     []byte
+	received []bool
+	left     int // fragments still missing
+	started  time.Time
+}
+
+// NewChunkedQueue returns a ChunkedQueue over mq.
+func NewChunkedQueue(mq *MessageQueue, config *ChunkConfig) *ChunkedQueue {
+	cq := &ChunkedQueue{
+		mq:        mq,
+		pending:   make(map[[16]byte]*partialPayload),
+		discarded: make(map[[16]byte]time.Time),
+	}
+	if config != nil {
+		cq.config = *config
+	}
+	if cq.config.MaxSize <= 0 {
+		cq.config.MaxSize = DefaultChunkMaxSize
+	}
+	if cq.config.MaxPending <= 0 {
+		cq.config.MaxPending = DefaultChunkMaxPending
+	}
+	if cq.config.Timeout <= 0 {
+		cq.config.Timeout = DefaultChunkTimeout
+	}
+	return cq
+}
+
+// Queue returns the underlying message queue.
+func (cq *ChunkedQueue) Queue() *MessageQueue {
+	return cq.mq
+}
+
+// Dropped returns the number of incomplete payloads dropped so far, because they timed out,
+// did not fit within MaxPending, exceeded MaxSize or had a fragment of the wrong length.
+func (cq *ChunkedQueue) Dropped() uint64 {
+	return cq.dropped.Load()
+}
+
+// Send sends data in as many fragments as needed, all with the given priority.
+func (cq *ChunkedQueue) Send(data []byte, priority uint) error {
+	return cq.SendContext(context.Background(), data, priority)
+}
+
+// SendContext sends data in as many fragments as needed, blocking until they are all sent or ctx is done.
+func (cq *ChunkedQueue) SendContext(ctx context.Context, data []byte, priority uint) error {
+	chunkSize := cq.mq.msgSize - chunkHeaderLen
+	if chunkSize <= 0 {
+		return cq.mq.opError("send", fmt.Errorf("msgsize %d leaves no room past the fragment header: %w", cq.mq.msgSize, syscall.EMSGSIZE))
+	}
+	if len(data) > cq.config.MaxSize {
+		return cq.mq.opError("send", fmt.Errorf("%d bytes payload, at most %d are reassembled: %w", len(data), cq.config.MaxSize, syscall.EMSGSIZE))
+	}
+	count := max((len(data)+chunkSize-1)/chunkSize, 1)
+
+	fragment := make([]byte, chunkHeaderLen, min(cq.mq.msgSize, chunkHeaderLen+len(data)))
+	copy(fragment, ChunkMagic[:])
+	fragment[4] = ChunkVersion
+	rand.Read(fragment[5:21])
+	binary.BigEndian.PutUint32(fragment[25:], uint32(count))
+	binary.BigEndian.PutUint64(fragment[29:], uint64(len(data)))
+	for i := 0; i < count; i++ {
+		binary.BigEndian.PutUint32(fragment[21:], uint32(i))
+		chunk := data[i*chunkSize : min((i+1)*chunkSize, len(data))]
+		fragment = append(fragment[:chunkHeaderLen], chunk...)
+		if err := cq.mq.SendContext(ctx, fragment, priority); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Receive receives fragments until a payload is complete and returns it, with the priority of its last fragment.
+func (cq *ChunkedQueue) Receive() ([]byte, uint, error) {
+	return cq.ReceiveContext(context.Background())
+}
+
+// ReceiveContext is Receive blocking until a payload is complete or ctx is done.
+func (cq *ChunkedQueue) ReceiveContext(ctx context.Context) ([]byte, uint, error) {
+	for {
+		msg, prio, err := cq.mq.ReceiveContext(ctx)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(msg) < chunkHeaderLen || [4]byte(msg[:4]) != ChunkMagic || msg[4] != ChunkVersion {
+			return msg, prio, nil
+		}
+		if data := cq.reassemble(msg, time.Now()); data != nil {
+			return data, prio, nil
+		}
+	}
+}
+
+// reassemble adds the fragment to its payload and returns the payload once complete.
+func (cq *ChunkedQueue) reassemble(fragment []byte, now time.Time) []byte {
+	id := [16]byte(fragment[5:21])
+	index := int(binary.BigEndian.Uint32(fragment[21:]))
+	count := int(binary.BigEndian.Uint32(fragment[25:]))
+	size := binary.BigEndian.Uint64(fragment[29:])
+	chunk := fragment[chunkHeaderLen:]
+	chunkSize := cq.mq.msgSize - chunkHeaderLen
+
+	if count == 1 && index == 0 && uint64(len(chunk)) == size {
+		return chunk
+	}
+
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+	cq.expire(now)
+
+	if _, ok := cq.discarded[id]; ok {
+		return nil
+	}
+	p, ok := cq.pending[id]
+	if !ok {
+		if size > uint64(cq.config.MaxSize) || size > uint64(cq.config.MaxPending) || count <= 1 ||
+			uint64(count) != (size+uint64(chunkSize)-1)/uint64(chunkSize) {
+			cq.discarded[id] = now
+			cq.dropped.Add(1)
+			return nil
+		}
+		//dropOldest needs a payload to drop, were the accounting ever to drift
+		for len(cq.pending) > 0 && cq.pendingBytes+int(size) > cq.config.MaxPending {
+			cq.dropOldest(now)
+		}
+		p = &partialPayload{data: make([]byte, size), received: make([]bool, count), left: count, started: now}
+		cq.pending[id] = p
+		cq.pendingBytes += int(size)
+	}
+	if index >= len(p.received) || p.received[index] {
+		return nil
+	}
+	//every fragment but the last fills a chunk, the last one holds what is left of the payload
+	start := index * chunkSize
+	want := chunkSize
+	if index == len(p.received)-1 {
+		want = len(p.data) - start
+	}
+	if len(chunk) != want {
+		cq.drop(id, p, now)
+		return nil
+	}
+	copy(p.data[start:], chunk)
+	p.received[index] = true
+	p.left--
+	if p.left > 0 {
+		return nil
+	}
+	delete(cq.pending, id)
+	cq.pendingBytes -= len(p.data)
+	return p.data
+}
+
+// expire drops the incomplete payloads started more than Timeout ago,
+// and forgets the payloads discarded as long ago, whose fragments are not expected anymore.
+func (cq *ChunkedQueue) expire(now time.Time) {
+	for id, p := range cq.pending {
+		if now.Sub(p.started) > cq.config.Timeout {
+			cq.drop(id, p, now)
+		}
+	}
+	for id, discarded := range cq.discarded {
+		if now.Sub(discarded) > cq.config.Timeout {
+			delete(cq.discarded, id)
+		}
+	}
+}
+
+func (cq *ChunkedQueue) dropOldest(now time.Time) {
+	var (
+		oldestID [16]byte
+		oldest   *partialPayload
+	)
+	for id, p := range cq.pending {
+		if oldest == nil || p.started.Before(oldest.started) {
+			oldestID, oldest = id, p
+		}
+	}
+	cq.drop(oldestID, oldest, now)
+}
+
+func (cq *ChunkedQueue) drop(id [16]byte, p *partialPayload, now time.Time) {
+	delete(cq.pending, id)
+	cq.discarded[id] = now
+	cq.pendingBytes -= len(p.data)
+	cq.dropped.Add(1)
+}
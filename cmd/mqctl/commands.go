@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nidhhoggr/posix_mq"
+)
+
+// queueJSON is the JSON form of a posix_mq.QueueInfo.
+type queueJSON struct {
+	Name      string    `json:"name"`
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	Notify    string    `json:"notify,omitempty"`
+	SigNo     int       `json:"signo,omitempty"`
+	NotifyPID int       `json:"notify_pid,omitempty"`
+	UID       uint32    `json:"uid"`
+	GID       uint32    `json:"gid"`
+	Mode      string    `json:"mode"`
+	ModTime   time.Time `json:"mtime"`
+}
+
+func newQueueJSON(qi *posix_mq.QueueInfo) queueJSON {
+	return queueJSON{
+		Name:      qi.Name,
+		Path:      qi.Path,
+		Size:      qi.Size,
+		Notify:    notifyMethod(qi),
+		SigNo:     qi.NotifySigNo,
+		NotifyPID: qi.NotifyPID,
+		UID:       qi.UID,
+		GID:       qi.GID,
+		Mode:      fmt.Sprintf("%04o", qi.Mode.Perm()),
+		ModTime:   qi.ModTime,
+	}
+}
+
+// notifyMethod names the notification registered on the queue, if any.
+func notifyMethod(qi *posix_mq.QueueInfo) string {
+	if !qi.Notified() {
+		return ""
+	}
+	switch qi.NotifyMethod {
+	case posix_mq.NotifySignal:
+		return "signal"
+	case posix_mq.NotifyNone:
+		return "none"
+	case posix_mq.NotifyThread:
+		return "thread"
+	}
+	return strconv.Itoa(qi.NotifyMethod)
+}
+
+// messageJSON is the JSON form of a message, carried as text when it is valid UTF-8 and base64 encoded otherwise.
+type messageJSON struct {
+	Queue    string `json:"queue"`
+	Priority uint   `json:"priority"`
+	Text     string `json:"text,omitempty"`
+	Data     []byte `json:"data,omitempty"`
+}
+
+func (o *output) message(name string, msg []byte, prio uint) error {
+	if o.json {
+		m := messageJSON{Queue: name, Priority: prio}
+		if utf8.Valid(msg) {
+			m.Text = string(msg)
+		} else {
+			m.Data = msg
+		}
+		return o.encode(m)
+	}
+	//messages are printed as is, one per line
+	if len(msg) == 0 || msg[len(msg)-1] != '\n' {
+		msg = append(msg, '\n')
+	}
+	_, err := o.w.Write(msg)
+	return err
+}
+
+func runList(ctx context.Context, out *output, fs *flag.FlagSet, args []string) error {
+	dir := fs.String("dir", posix_mq.POSIX_MQ_DIR, "mount point of the mqueue filesystem")
+	if err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	queues, err := posix_mq.ListQueues(*dir)
+	if err != nil {
+		return err
+	}
+	if out.json {
+		for i := range queues {
+			if err := out.encode(newQueueJSON(&queues[i])); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	w := out.table()
+	fmt.Fprintln(w, "NAME\tSIZE\tNOTIFY\tPID\tMODE\tUID\tGID\tMODIFIED")
+	for i := range queues {
+		q := newQueueJSON(&queues[i])
+		fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%s\t%d\t%d\t%s\n",
+			q.Name, q.Size, orDash(q.Notify), q.NotifyPID, q.Mode, q.UID, q.GID, q.ModTime.Format(time.DateTime))
+	}
+	return w.Flush()
+}
+
+func runStat(ctx context.Context, out *output, fs *flag.FlagSet, args []string) error {
+	if err := parseFlags(fs, args, 1); err != nil {
+		return err
+	}
+
+	w := out.table()
+	for i, name := range fs.Args() {
+		qi, err := posix_mq.Stat(name)
+		if err != nil {
+			return err
+		}
+		q := newQueueJSON(qi)
+		if out.json {
+			if err := out.encode(q); err != nil {
+				return err
+			}
+			continue
+		}
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "Name:\t%s\n", q.Name)
+		fmt.Fprintf(w, "Path:\t%s\n", q.Path)
+		fmt.Fprintf(w, "Size:\t%d\n", q.Size)
+		fmt.Fprintf(w, "Notify:\t%s\n", orDash(q.Notify))
+		fmt.Fprintf(w, "Signal:\t%d\n", q.SigNo)
+		fmt.Fprintf(w, "Notify PID:\t%d\n", q.NotifyPID)
+		fmt.Fprintf(w, "Mode:\t%s\n", q.Mode)
+		fmt.Fprintf(w, "Owner:\t%d/%d\n", q.UID, q.GID)
+		fmt.Fprintf(w, "Modified:\t%s\n", q.ModTime.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func runCreate(ctx context.Context, out *output, fs *flag.FlagSet, args []string) error {
+	maxMsg := fs.Int("maxmsg", 0, "maximum number of messages, 0 for the system default")
+	msgSize := fs.Int("msgsize", 0, "maximum message size in bytes, 0 for the system default")
+	mode := fs.String("mode", "0600", "permissions of the queue, in octal")
+	excl := fs.Bool("excl", false, "fail if the queue exists already")
+	if err := parseFlags(fs, args, 1); err != nil {
+		return err
+	}
+	perm, err := strconv.ParseUint(*mode, 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid mode %q", *mode)
+	}
+
+	config := &posix_mq.QueueConfig{
+		Name:  queueName(fs.Arg(0)),
+		Flags: posix_mq.O_RDONLY | posix_mq.O_CREAT,
+		Mode:  int(perm),
+	}
+	if *excl {
+		config.Flags |= posix_mq.O_EXCL
+	}
+	if *maxMsg != 0 || *msgSize != 0 {
+		//the kernel takes both attributes or none, fill in the one left out
+		limits, err := posix_mq.SystemLimits()
+		if err != nil {
+			return err
+		}
+		attrs := &posix_mq.MessageQueueAttribute{MaxMsg: *maxMsg, MsgSize: *msgSize}
+		if attrs.MaxMsg == 0 {
+			attrs.MaxMsg = limits.MsgDefault
+		}
+		if attrs.MsgSize == 0 {
+			attrs.MsgSize = limits.MsgSizeDefault
+		}
+		config.Attrs = attrs
+	}
+	mq, err := posix_mq.NewMessageQueue(config)
+	if err != nil {
+		return err
+	}
+	return mq.Close()
+}
+
+func runSend(ctx context.Context, out *output, fs *flag.FlagSet, args []string) error {
+	prio := fs.Uint("prio", 0, "priority of the message")
+	timeout := fs.Duration("timeout", 0, "give up when the queue stays full for this long, 0 waits forever")
+	ttl := fs.Duration("ttl", 0, "discard the message on receipt once this long has passed, 0 keeps it forever")
+	if err := parseFlags(fs, args, 1); err != nil {
+		return err
+	}
+
+	var msg []byte
+	if fs.NArg() > 1 {
+		msg = []byte(strings.Join(fs.Args()[1:], " "))
+	} else {
+		var err error
+		if msg, err = io.ReadAll(os.Stdin); err != nil {
+			return err
+		}
+	}
+
+	mq, err := posix_mq.NewMessageQueue(&posix_mq.QueueConfig{
+		Name:  queueName(fs.Arg(0)),
+		Flags: posix_mq.O_WRONLY,
+	})
+	if err != nil {
+		return err
+	}
+	defer mq.Close()
+
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	if *ttl > 0 {
+		return mq.SendWithTTLContext(ctx, msg, *prio, *ttl)
+	}
+	return mq.SendContext(ctx, msg, *prio)
+}
+
+func runRecv(ctx context.Context, out *output, fs *flag.FlagSet, args []string) error {
+	count := fs.Int("n", 1, "number of messages to receive")
+	timeout := fs.Duration("timeout", 0, "give up when the queue stays empty for this long, 0 waits forever")
+	nonblock := fs.Bool("nonblock", false, "fail instead of waiting when the queue is empty")
+	ttl := fs.Bool("ttl", false, "strip the deadlines of the messages sent with send -ttl, skipping the expired ones")
+	if err := parseFlags(fs, args, 1); err != nil {
+		return err
+	}
+
+	name := queueName(fs.Arg(0))
+	flags := posix_mq.O_RDONLY
+	if *nonblock {
+		flags |= posix_mq.O_NONBLOCK
+	}
+	mq, err := posix_mq.NewMessageQueue(&posix_mq.QueueConfig{Name: name, Flags: flags, TTL: *ttl})
+	if err != nil {
+		return err
+	}
+	defer mq.Close()
+
+	for i := 0; i < *count; i++ {
+		recvCtx, cancel := ctx, context.CancelFunc(func() {})
+		if *timeout > 0 {
+			recvCtx, cancel = context.WithTimeout(ctx, *timeout)
+		}
+		msg, prio, err := mq.ReceiveContext(recvCtx)
+		cancel()
+		if err != nil {
+			return err
+		}
+		if err := out.message(name, msg, prio); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runTail(ctx context.Context, out *output, fs *flag.FlagSet, args []string) error {
+	follow := fs.Bool("f", false, "keep waiting for new messages until interrupted")
+	ttl := fs.Bool("ttl", false, "strip the deadlines of the messages sent with send -ttl, skipping the expired ones")
+	if err := parseFlags(fs, args, 1); err != nil {
+		return err
+	}
+
+	name := queueName(fs.Arg(0))
+	flags := posix_mq.O_RDONLY
+	if !*follow {
+		flags |= posix_mq.O_NONBLOCK
+	}
+	mq, err := posix_mq.NewMessageQueue(&posix_mq.QueueConfig{Name: name, Flags: flags, TTL: *ttl})
+	if err != nil {
+		return err
+	}
+	defer mq.Close()
+
+	for {
+		msg, prio, err := mq.ReceiveContext(ctx)
+		if errors.Is(err, posix_mq.ErrQueueEmpty) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := out.message(name, msg, prio); err != nil {
+			return err
+		}
+	}
+}
+
+func runPurge(ctx context.Context, out *output, fs *flag.FlagSet, args []string) error {
+	save := fs.String("o", "", "append the purged messages to this file, as JSON lines")
+	if err := parseFlags(fs, args, 1); err != nil {
+		return err
+	}
+
+	var saved *output
+	if *save != "" {
+		f, err := os.OpenFile(*save, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		saved = &output{w: f, json: true}
+	}
+
+	w := out.table()
+	if !out.json {
+		fmt.Fprintln(w, "NAME\tPURGED")
+	}
+	for _, name := range fs.Args() {
+		name = queueName(name)
+		purged, err := purge(name, saved)
+		if err != nil {
+			return err
+		}
+		if out.json {
+			if err := out.encode(struct {
+				Name   string `json:"name"`
+				Purged int    `json:"purged"`
+			}{name, purged}); err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\n", name, purged)
+	}
+	if out.json {
+		return nil
+	}
+	return w.Flush()
+}
+
+func runRedrive(ctx context.Context, out *output, fs *flag.FlagSet, args []string) error {
+	to := fs.String("to", "", "move the dead letters to this queue instead")
+	if err := parseFlags(fs, args, 1); err != nil {
+		return err
+	}
+	name := queueName(fs.Arg(0))
+	//dead letters that cannot be moved are put back
+	dlq, err := posix_mq.NewMessageQueue(&posix_mq.QueueConfig{
+		Name:  name,
+		Flags: posix_mq.O_RDWR,
+	})
+	if err != nil {
+		return err
+	}
+	defer dlq.Close()
+
+	var moved int
+	if *to != "" {
+		target, err := posix_mq.NewMessageQueue(&posix_mq.QueueConfig{
+			Name:  queueName(*to),
+			Flags: posix_mq.O_WRONLY,
+		})
+		if err != nil {
+			return err
+		}
+		defer target.Close()
+		moved, err = dlq.RedriveTo(target)
+	} else {
+		moved, err = dlq.Redrive()
+	}
+	if err != nil {
+		return fmt.Errorf("%d dead letters moved before the error: %w", moved, err)
+	}
+
+	if out.json {
+		return out.encode(struct {
+			Name  string `json:"name"`
+			Moved int    `json:"moved"`
+		}{name, moved})
+	}
+	w := out.table()
+	fmt.Fprintln(w, "NAME\tMOVED")
+	fmt.Fprintf(w, "%s\t%d\n", name, moved)
+	return w.Flush()
+}
+
+// purge discards the messages queued in the queue called name, writing them to saved unless it is nil,
+// and returns how many there were.
+func purge(name string, saved *output) (int, error) {
+	mq, err := posix_mq.NewMessageQueue(&posix_mq.QueueConfig{
+		Name:  name,
+		Flags: posix_mq.O_RDONLY,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer mq.Close()
+
+	if saved == nil {
+		return mq.Purge()
+	}
+	return mq.DrainTo(posix_mq.SinkFunc(func(data []byte, priority uint) error {
+		return saved.message(name, data, priority)
+	}))
+}
+
+func runRemove(ctx context.Context, out *output, fs *flag.FlagSet, args []string) error {
+	if err := parseFlags(fs, args, 1); err != nil {
+		return err
+	}
+
+	for _, name := range fs.Args() {
+		if err := posix_mq.ForceRemoveQueue(queueName(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
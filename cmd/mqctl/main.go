@@ -0,0 +1,162 @@
+// Command mqctl inspects and operates POSIX message queues.
+//
+// Usage:
+//
+//	mqctl [-json] <command> [flags] [arguments]
+//
+// The commands are:
+//
+//	ls       list the queues
+//	stat     show the details of queues
+//	create   create a queue
+//	send     send a message, read from the arguments or stdin
+//	recv     receive messages
+//	tail     print the queued messages, and with -f keep waiting for new ones
+//	purge    discard the queued messages, optionally saving them to a file
+//	redrive  move the dead letters of a dead-letter queue back to the queues they failed on
+//	rm       delete queues
+//
+// POSIX message queues cannot be peeked at, so recv, tail and purge consume the messages they read.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+)
+
+// errUsage is returned by commands called with bad arguments, after printing their usage.
+var errUsage = errors.New("usage")
+
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(ctx context.Context, out *output, fs *flag.FlagSet, args []string) error
+}
+
+var commands = []command{
+	{"ls", "[-dir dir]", "list the queues", runList},
+	{"stat", "name...", "show the details of queues", runStat},
+	{"create", "[-maxmsg n] [-msgsize n] [-mode perm] [-excl] name", "create a queue", runCreate},
+	{"send", "[-prio n] [-timeout d] [-ttl d] name [message...]", "send a message, read from stdin without message", runSend},
+	{"recv", "[-n count] [-timeout d] [-nonblock] [-ttl] name", "receive messages", runRecv},
+	{"tail", "[-f] [-ttl] name", "print the queued messages, and with -f keep waiting for new ones", runTail},
+	{"purge", "[-o file] name...", "discard the queued messages, saving them to file", runPurge},
+	{"redrive", "[-to queue] name", "move the dead letters back to the queues they failed on, or to queue", runRedrive},
+	{"rm", "name...", "delete queues", runRemove},
+}
+
+func main() {
+	//stop waiting on the queues on Ctrl-C, letting tail -f exit cleanly
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	code := run(ctx, os.Args[1:], os.Stdout, os.Stderr)
+	stop()
+	os.Exit(code)
+}
+
+// run runs mqctl with args, printing the results to stdout and the errors to stderr, and returns the exit code:
+// 1 when the command failed and 2 for bad usage.
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	global := flag.NewFlagSet("mqctl", flag.ContinueOnError)
+	global.SetOutput(stderr)
+	global.Usage = func() { usage(stderr) }
+	jsonOutput := global.Bool("json", false, "print JSON instead of tables")
+	if err := global.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if global.NArg() == 0 {
+		usage(stderr)
+		return 2
+	}
+
+	name := global.Arg(0)
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+		out := &output{w: stdout, json: *jsonOutput}
+		fs := newFlagSet(cmd)
+		fs.SetOutput(stderr)
+		err := cmd.run(ctx, out, fs, global.Args()[1:])
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		if errors.Is(err, errUsage) {
+			return 2
+		}
+		if err != nil && !errors.Is(err, context.Canceled) {
+			fmt.Fprintf(stderr, "mqctl %s: %s\n", name, err)
+			return 1
+		}
+		return 0
+	}
+	fmt.Fprintf(stderr, "mqctl: unknown command %q\n", name)
+	usage(stderr)
+	return 2
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "usage: mqctl [-json] <command> [flags] [arguments]\n\ncommands:\n")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", cmd.name, cmd.args, cmd.summary)
+	}
+	tw.Flush()
+}
+
+// newFlagSet returns the flag set of cmd, printing its usage on errors.
+func newFlagSet(cmd command) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: mqctl %s %s\n", cmd.name, cmd.args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseFlags parses args and checks that at least minArgs arguments are left.
+func parseFlags(fs *flag.FlagSet, args []string, minArgs int) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() < minArgs {
+		fs.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+// queueName returns the name of a queue as NewMessageQueue expects it, without the leading slash.
+func queueName(name string) string {
+	return strings.TrimPrefix(name, "/")
+}
+
+// output prints the results of the commands either as tables or as JSON, one value per line.
+type output struct {
+	w    io.Writer
+	json bool
+}
+
+// table returns a writer aligning tab separated columns, to be flushed once the rows are written.
+func (o *output) table() *tabwriter.Writer {
+	return tabwriter.NewWriter(o.w, 0, 4, 2, ' ', 0)
+}
+
+func (o *output) encode(v any) error {
+	return json.NewEncoder(o.w).Encode(v)
+}
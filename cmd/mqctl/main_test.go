@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nidhhoggr/posix_mq"
+	"github.com/nidhhoggr/posix_mq/posix_mqtest"
+)
+
+func TestMain(m *testing.M) {
+	posix_mqtest.VerifyNoLeaks(m)
+}
+
+// mqctl runs mqctl with args and returns its exit code, stdout and stderr.
+func mqctl(t *testing.T, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+// expectExit runs mqctl with args, failing the test unless it exits with code, and returns stdout.
+func expectExit(t *testing.T, code int, args ...string) string {
+	t.Helper()
+	got, stdout, stderr := mqctl(t, args...)
+	if got != code {
+		t.Fatalf("mqctl %s: expected exit code %d, got %d: %s", strings.Join(args, " "), code, got, stderr)
+	}
+	return stdout
+}
+
+// decodeLines decodes the JSON values printed one per line.
+func decodeLines[T any](t *testing.T, stdout string) []T {
+	t.Helper()
+	var values []T
+	dec := json.NewDecoder(strings.NewReader(stdout))
+	for dec.More() {
+		var v T
+		if err := dec.Decode(&v); err != nil {
+			t.Fatalf("decoding %q: %s", stdout, err)
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+func TestUsage(t *testing.T) {
+	expectExit(t, 2)
+	expectExit(t, 2, "frobnicate")
+	expectExit(t, 2, "-bogus", "ls")
+	expectExit(t, 0, "-h")
+	expectExit(t, 0, "ls", "-h")
+	//commands missing their arguments
+	for _, cmd := range []string{"stat", "send", "recv", "purge", "rm"} {
+		expectExit(t, 2, cmd)
+	}
+}
+
+func TestList(t *testing.T) {
+	mq := posix_mqtest.NewTestQueue(t, &posix_mqtest.Options{Mode: 0640})
+	name := mq.Name()
+
+	stdout := expectExit(t, 0, "ls")
+	lines := strings.Split(stdout, "\n")
+	if fields := strings.Fields(lines[0]); strings.Join(fields, " ") != "NAME SIZE NOTIFY PID MODE UID GID MODIFIED" {
+		t.Errorf("unexpected header %q", lines[0])
+	}
+	found := false
+	for _, line := range lines[1:] {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] == name {
+			found = true
+			if fields[1] != "0" || fields[2] != "-" || fields[4] != "0640" {
+				t.Errorf("unexpected row %q", line)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("%s not listed in %q", name, stdout)
+	}
+
+	found = false
+	for _, q := range decodeLines[queueJSON](t, expectExit(t, 0, "-json", "ls")) {
+		if q.Name == name {
+			found = true
+			if q.Path != filepath.Join(posix_mq.POSIX_MQ_DIR, name) || q.Mode != "0640" || q.Notify != "" {
+				t.Errorf("unexpected queue %+v", q)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("%s not listed as JSON", name)
+	}
+
+	expectExit(t, 1, "ls", "-dir", filepath.Join(t.TempDir(), "missing"))
+}
+
+func TestStat(t *testing.T) {
+	mq := posix_mqtest.NewTestQueue(t, &posix_mqtest.Options{Mode: 0600})
+	name := mq.Name()
+	if err := mq.Send([]byte("hello"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := expectExit(t, 0, "stat", "/"+name)
+	for _, want := range []string{"Name:", name, "Size:", "Notify:", "-", "Mode:", "0600"} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("expected %q in %q", want, stdout)
+		}
+	}
+
+	queues := decodeLines[queueJSON](t, expectExit(t, 0, "-json", "stat", name, name))
+	if len(queues) != 2 {
+		t.Fatalf("expected 2 queues, got %d", len(queues))
+	}
+	if queues[0].Name != name || queues[0].Size != 5 || queues[0].Mode != "0600" {
+		t.Errorf("unexpected queue %+v", queues[0])
+	}
+
+	_, _, stderr := mqctl(t, "stat", posix_mqtest.Name(t))
+	if !strings.HasPrefix(stderr, "mqctl stat: ") {
+		t.Errorf("unexpected error %q", stderr)
+	}
+	expectExit(t, 1, "stat", posix_mqtest.Name(t))
+}
+
+func TestSendRecv(t *testing.T) {
+	mq := posix_mqtest.NewTestQueue(t, nil)
+	name := mq.Name()
+
+	if stdout := expectExit(t, 0, "send", name, "hello", "world"); stdout != "" {
+		t.Errorf("unexpected output %q", stdout)
+	}
+	expectExit(t, 0, "send", "-prio", "3", "/"+name, "urgent")
+	expectExit(t, 0, "send", "-ttl", "1m", name, "fresh")
+	posix_mqtest.AssertCount(t, mq, 3)
+
+	if stdout := expectExit(t, 0, "recv", "-n", "2", name); stdout != "urgent\nhello world\n" {
+		t.Errorf("unexpected messages %q", stdout)
+	}
+	messages := decodeLines[messageJSON](t, expectExit(t, 0, "-json", "recv", "-ttl", name))
+	if len(messages) != 1 || !reflect.DeepEqual(messages[0], messageJSON{Queue: name, Text: "fresh"}) {
+		t.Errorf("unexpected messages %+v", messages)
+	}
+
+	//binary messages are base64 encoded
+	if err := mq.Send([]byte{0xff, 0x00}, 1); err != nil {
+		t.Fatal(err)
+	}
+	messages = decodeLines[messageJSON](t, expectExit(t, 0, "-json", "recv", name))
+	if len(messages) != 1 || !bytes.Equal(messages[0].Data, []byte{0xff, 0x00}) || messages[0].Priority != 1 {
+		t.Errorf("unexpected messages %+v", messages)
+	}
+
+	expectExit(t, 1, "recv", "-nonblock", name)
+	expectExit(t, 1, "recv", "-timeout", "10ms", name)
+	expectExit(t, 1, "send", "-prio", "100000", name, "too urgent")
+	expectExit(t, 2, "send", "-prio", "high", name, "urgent")
+	missing := posix_mqtest.Name(t)
+	expectExit(t, 1, "send", missing, "lost")
+	expectExit(t, 1, "recv", missing)
+}
+
+func TestPurge(t *testing.T) {
+	mq := posix_mqtest.NewTestQueue(t, nil)
+	name := mq.Name()
+	other := posix_mqtest.NewTestQueue(t, nil)
+	for i, msg := range []string{"a", "b", "c"} {
+		if err := mq.Send([]byte(msg), uint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stdout := expectExit(t, 0, "purge", name, other.Name())
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	if len(lines) != 3 || strings.Join(strings.Fields(lines[0]), " ") != "NAME PURGED" ||
+		strings.Join(strings.Fields(lines[1]), " ") != name+" 3" ||
+		strings.Join(strings.Fields(lines[2]), " ") != other.Name()+" 0" {
+		t.Errorf("unexpected output %q", stdout)
+	}
+	posix_mqtest.AssertEmpty(t, mq)
+
+	//the purged messages are saved as JSON lines
+	if err := mq.Send([]byte("saved"), 2); err != nil {
+		t.Fatal(err)
+	}
+	saved := filepath.Join(t.TempDir(), "purged.jsonl")
+	type purgeJSON struct {
+		Name   string `json:"name"`
+		Purged int    `json:"purged"`
+	}
+	results := decodeLines[purgeJSON](t, expectExit(t, 0, "-json", "purge", "-o", saved, name))
+	if len(results) != 1 || results[0] != (purgeJSON{Name: name, Purged: 1}) {
+		t.Errorf("unexpected results %+v", results)
+	}
+	content, err := os.ReadFile(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := decodeLines[messageJSON](t, string(content))
+	if len(messages) != 1 || !reflect.DeepEqual(messages[0], messageJSON{Queue: name, Priority: 2, Text: "saved"}) {
+		t.Errorf("unexpected saved messages %+v", messages)
+	}
+
+	expectExit(t, 1, "purge", posix_mqtest.Name(t))
+}
+
+func TestRemove(t *testing.T) {
+	first := posix_mqtest.NewTestQueue(t, nil)
+	second := posix_mqtest.NewTestQueue(t, nil)
+
+	if stdout := expectExit(t, 0, "rm", first.Name(), "/"+second.Name()); stdout != "" {
+		t.Errorf("unexpected output %q", stdout)
+	}
+	for _, name := range []string{first.Name(), second.Name()} {
+		if _, err := posix_mq.Stat(name); !errors.Is(err, posix_mq.ErrNotFound) {
+			t.Errorf("expected %s to be removed, got %v", name, err)
+		}
+	}
+	expectExit(t, 1, "rm", first.Name())
+}
+
+func TestCreate(t *testing.T) {
+	name := posix_mqtest.Name(t)
+	t.Cleanup(func() {
+		posix_mq.ForceRemoveQueue(name)
+	})
+
+	if stdout := expectExit(t, 0, "create", "-maxmsg", "4", "-msgsize", "64", "-mode", "0640", "/"+name); stdout != "" {
+		t.Errorf("unexpected output %q", stdout)
+	}
+	mq, err := posix_mq.NewMessageQueue(&posix_mq.QueueConfig{Name: name, Flags: posix_mq.O_RDONLY})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mq.Close()
+	attr, err := mq.GetAttr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attr.MaxMsg != 4 || attr.MsgSize != 64 {
+		t.Errorf("unexpected attributes %+v", attr)
+	}
+	info, err := os.Stat(filepath.Join(posix_mq.POSIX_MQ_DIR, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("unexpected mode %s", info.Mode())
+	}
+
+	//an existing queue is left as is, unless -excl
+	expectExit(t, 0, "create", "-maxmsg", "8", name)
+	if attr, err := mq.GetAttr(); err != nil || attr.MaxMsg != 4 {
+		t.Errorf("unexpected attributes %+v: %v", attr, err)
+	}
+	expectExit(t, 1, "create", "-excl", name)
+	expectExit(t, 1, "create", "-mode", "rw", posix_mqtest.Name(t))
+	expectExit(t, 2, "create", "-maxmsg", "many", name)
+}
+
+func TestTail(t *testing.T) {
+	mq := posix_mqtest.NewTestQueue(t, nil)
+	name := mq.Name()
+	for i, msg := range []string{"a", "b", "c"} {
+		if err := mq.Send([]byte(msg), uint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if stdout := expectExit(t, 0, "tail", name); stdout != "c\nb\na\n" {
+		t.Errorf("unexpected messages %q", stdout)
+	}
+	posix_mqtest.AssertEmpty(t, mq)
+	if stdout := expectExit(t, 0, "tail", name); stdout != "" {
+		t.Errorf("unexpected messages %q", stdout)
+	}
+
+	if err := mq.Send([]byte("json"), 5); err != nil {
+		t.Fatal(err)
+	}
+	messages := decodeLines[messageJSON](t, expectExit(t, 0, "-json", "tail", name))
+	if len(messages) != 1 || !reflect.DeepEqual(messages[0], messageJSON{Queue: name, Priority: 5, Text: "json"}) {
+		t.Errorf("unexpected messages %+v", messages)
+	}
+
+	expectExit(t, 1, "tail", posix_mqtest.Name(t))
+}
+
+func TestTailFollow(t *testing.T) {
+	mq := posix_mqtest.NewTestQueue(t, nil)
+	name := mq.Name()
+	if err := mq.Send([]byte("before"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	//tail -f keeps waiting on the empty queue until interrupted, which is not an error
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	exit := make(chan int)
+	go func() {
+		exit <- run(ctx, []string{"tail", "-f", name}, &stdout, &stderr)
+	}()
+	waitEmpty(t, mq)
+	if err := mq.Send([]byte("after"), 0); err != nil {
+		t.Fatal(err)
+	}
+	waitEmpty(t, mq)
+	select {
+	case code := <-exit:
+		t.Fatalf("tail -f exited with code %d: %s", code, stderr.String())
+	case <-time.After(10 * time.Millisecond):
+	}
+	cancel()
+	if code := <-exit; code != 0 {
+		t.Errorf("expected exit code 0, got %d: %s", code, stderr.String())
+	}
+	if stdout.String() != "before\nafter\n" {
+		t.Errorf("unexpected messages %q", stdout.String())
+	}
+}
+
+// waitEmpty waits for mq to be emptied by another reader.
+func waitEmpty(t *testing.T, mq *posix_mq.MessageQueue) {
+	t.Helper()
+	for deadline := time.Now().Add(posix_mqtest.ReceiveTimeout); ; time.Sleep(time.Millisecond) {
+		attr, err := mq.GetAttr()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attr.MsgCnt == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("queue still holds %d messages", attr.MsgCnt)
+		}
+	}
+}
+
+func TestSendTTL(t *testing.T) {
+	mq := posix_mqtest.NewTestQueue(t, nil)
+	name := mq.Name()
+
+	//without -ttl the deadline header is received as part of the message
+	expectExit(t, 0, "send", "-ttl", "1m", name, "fresh")
+	messages := decodeLines[messageJSON](t, expectExit(t, 0, "-json", "recv", name))
+	if len(messages) != 1 || len(messages[0].Data) != 13+len("fresh") ||
+		!bytes.HasPrefix(messages[0].Data, posix_mq.TTLMagic[:]) || !bytes.HasSuffix(messages[0].Data, []byte("fresh")) {
+		t.Errorf("unexpected messages %+v", messages)
+	}
+
+	expectExit(t, 0, "send", "-ttl", "1m", "-prio", "2", name, "fresh")
+	if stdout := expectExit(t, 0, "recv", "-ttl", name); stdout != "fresh\n" {
+		t.Errorf("unexpected messages %q", stdout)
+	}
+	expectExit(t, 0, "send", "-ttl", "1m", name, "tailed")
+	if stdout := expectExit(t, 0, "tail", "-ttl", name); stdout != "tailed\n" {
+		t.Errorf("unexpected messages %q", stdout)
+	}
+
+	//expired messages are skipped
+	expectExit(t, 0, "send", "-ttl", "1ns", name, "stale")
+	time.Sleep(time.Millisecond)
+	expectExit(t, 1, "recv", "-ttl", "-nonblock", name)
+	posix_mqtest.AssertEmpty(t, mq)
+
+	expectExit(t, 2, "send", "-ttl", "soon", name, "fresh")
+}
+
+func TestRedrive(t *testing.T) {
+	source := posix_mqtest.NewTestQueue(t, nil)
+	other := posix_mqtest.NewTestQueue(t, nil)
+	dlq := posix_mqtest.NewTestQueue(t, nil)
+	deadLetter := func(payload string) {
+		t.Helper()
+		m := posix_mq.Message{
+			Headers: map[string]string{
+				posix_mq.HeaderDeadLetterSource:   source.Name(),
+				posix_mq.HeaderDeadLetterPriority: "3",
+			},
+			Data: []byte(payload),
+		}
+		data, err := m.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := dlq.Send(data, 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//dead letters go back to their source, other messages stay in the dead-letter queue
+	deadLetter("poison")
+	if err := dlq.Send([]byte("not a dead letter"), 1); err != nil {
+		t.Fatal(err)
+	}
+	stdout := expectExit(t, 0, "redrive", dlq.Name())
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	if len(lines) != 2 || strings.Join(strings.Fields(lines[0]), " ") != "NAME MOVED" ||
+		strings.Join(strings.Fields(lines[1]), " ") != dlq.Name()+" 1" {
+		t.Errorf("unexpected output %q", stdout)
+	}
+	posix_mqtest.AssertReceives(t, source, []byte("poison"), 3)
+	posix_mqtest.AssertCount(t, dlq, 1)
+
+	deadLetter("elsewhere")
+	type redriveJSON struct {
+		Name  string `json:"name"`
+		Moved int    `json:"moved"`
+	}
+	results := decodeLines[redriveJSON](t, expectExit(t, 0, "-json", "redrive", "-to", "/"+other.Name(), dlq.Name()))
+	if len(results) != 1 || results[0] != (redriveJSON{Name: dlq.Name(), Moved: 1}) {
+		t.Errorf("unexpected results %+v", results)
+	}
+	posix_mqtest.AssertReceives(t, other, []byte("elsewhere"), 3)
+	posix_mqtest.AssertEmpty(t, source)
+	posix_mqtest.AssertCount(t, dlq, 1)
+
+	expectExit(t, 1, "redrive", posix_mqtest.Name(t))
+	expectExit(t, 1, "redrive", "-to", posix_mqtest.Name(t), dlq.Name())
+}
@@ -0,0 +1,75 @@
+package posix_mq
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// Codec converts the values carried by a TypedQueue to and from messages.
+// Decode must not retain data, which is reused once it returns.
+type Codec[T any] interface {
+	Encode(v T) ([]byte, error)
+	Decode(data []byte, v *T) error
+}
+
+// JSONCodec encodes values with encoding/json.
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[T]) Decode(data []byte, v *T) error {
+	return json.Unmarshal(data, v)
+}
+
+// GobCodec encodes values with encoding/gob.
+// Every message carries its own type information, so messages can be decoded one by one in any order.
+type GobCodec[T any] struct{}
+
+func (GobCodec[T]) Encode(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec[T]) Decode(data []byte, v *T) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// BinaryCodec encodes fixed-size values, such as structs of numbers and arrays, with encoding/binary.
+// Order defaults to binary.NativeEndian, as both ends of a queue share the machine.
+type BinaryCodec[T any] struct {
+	Order binary.ByteOrder
+}
+
+func (c BinaryCodec[T]) order() binary.ByteOrder {
+	if c.Order == nil {
+		return binary.NativeEndian
+	}
+	return c.Order
+}
+
+func (c BinaryCodec[T]) Encode(v T) ([]byte, error) {
+	size := binary.Size(v)
+	if size < 0 {
+		return nil, fmt.Errorf("posix_mq: %T is not a fixed-size value", v)
+	}
+	return binary.Append(make([]byte, 0, size), c.order(), v)
+}
+
+func (c BinaryCodec[T]) Decode(data []byte, v *T) error {
+	n, err := binary.Decode(data, c.order(), v)
+	if err != nil {
+		return err
+	}
+	if n != len(data) {
+		return fmt.Errorf("posix_mq: %d bytes left after decoding %T", len(data)-n, *v)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package posix_mq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+)
+
+// Handler processes a message received by a Consumer.
+// ctx is only cancelled when a Shutdown runs out of time, so that messages in flight can be finished.
+type Handler func(ctx context.Context, msg []byte, prio uint) error
+
+// PanicError is reported for a handler that panicked, the Consumer going on with the next messages.
+type PanicError struct {
+	Value any    // the value passed to panic
+	Stack []byte // the stack of the handler goroutine when it panicked
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("posix_mq: handler panicked: %v", e.Value)
+}
+
+// Consumer receives messages from a queue and hands each one to a handler in its own goroutine,
+// with at most Concurrency handlers running at once. No message is received while they all are,
+// so the messages waiting for a handler stay in the queue.
+//
+// A Consumer is shut down by cancelling the context passed to Run, e.g. one from signal.NotifyContext
+// for SIGTERM, or by Shutdown. Either way it stops receiving and waits for the handlers still running.
+type Consumer struct {
+	// OnError is called with the error returned by a handler, or a *PanicError when it panicked,
+	// and the message it failed on, once the message is given up on. The error also reports a failure
+	// to send the message to DeadLetter. The errors are logged with the standard logger when nil.
+	// OnError may be called from several goroutines at once.
+	OnError func(err error, msg []byte, prio uint)
+
+	// Retry has a failed message handled again after a backoff, by the same goroutine, until it succeeds
+	// or runs out of attempts. A message is only handled once when nil.
+	// A message still backing off when a Shutdown runs out of time is given up on.
+	Retry *RetryPolicy
+
+	// DeadLetter receives the messages given up on, in an envelope whose headers tell where and why they failed,
+	// see HeaderDeadLetterSource; Redrive moves them back. Sending waits for room on DeadLetter, keeping the handler
+	// busy, until the handler context is cancelled. A dead letter larger than the messages of DeadLetter is not sent
+	// and reported to OnError with ErrMessageTooLarge, as is any other failure to send; HeaderDeadLetterError is
+	// truncated to keep the envelope small. The messages given up on are dropped when nil.
+	DeadLetter *MessageQueue
+
+	mq          *MessageQueue
+	handler     Handler
+	concurrency int
+
+	mu             sync.Mutex
+	started        bool
+	stopped        bool
+	stop           context.CancelFunc // stops receiving
+	cancelHandlers context.CancelFunc
+	done           chan struct{} // closed when Run returns
+}
+
+// NewConsumer returns a Consumer handing the messages of mq to handler, with at most concurrency handlers
+// running at once; a concurrency below 1 means 1.
+func NewConsumer(mq *MessageQueue, handler Handler, concurrency int) *Consumer {
+	return &Consumer{
+		mq:          mq,
+		handler:     handler,
+		concurrency: max(concurrency, 1),
+		done:        make(chan struct{}),
+	}
+}
+
+// Run receives and handles messages until ctx is done, Shutdown is called or the queue is closed,
+// then waits for the handlers still running. It returns ctx.Err() when ctx is done, nil when stopped by
+// Shutdown or by closing the queue, and the error of the receive otherwise, e.g. ErrQueueEmpty on
+// a non-blocking queue. Run can only be called once.
+func (c *Consumer) Run(ctx context.Context) error {
+	c.mu.Lock()
+	if c.started {
+		c.mu.Unlock()
+		return errors.New("posix_mq: consumer already started")
+	}
+	c.started = true
+	recvCtx, stop := context.WithCancel(ctx)
+	handlerCtx, cancelHandlers := context.WithCancel(context.WithoutCancel(ctx))
+	c.stop, c.cancelHandlers = stop, cancelHandlers
+	if c.stopped {
+		stop()
+	}
+	c.mu.Unlock()
+	defer close(c.done)
+	defer cancelHandlers()
+	defer stop()
+
+	var (
+		inflight sync.WaitGroup
+		slots    = make(chan struct{}, c.concurrency)
+		err      error
+	)
+	for err == nil {
+		select {
+		case slots <- struct{}{}:
+		case <-recvCtx.Done():
+			err = recvCtx.Err()
+			continue
+		}
+		msg, prio, recvErr := c.mq.ReceiveContext(recvCtx)
+		if recvErr != nil {
+			err = recvErr
+			continue
+		}
+		inflight.Add(1)
+		go func() {
+			defer inflight.Done()
+			defer func() { <-slots }()
+			c.handle(handlerCtx, msg, prio)
+		}()
+	}
+	inflight.Wait()
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if recvCtx.Err() != nil || errors.Is(err, ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func (c *Consumer) handle(ctx context.Context, msg []byte, prio uint) {
+	policy := RetryPolicy{MaxAttempts: 1}
+	if c.Retry != nil {
+		policy = c.Retry.withDefaults()
+	}
+	attempts := 0
+	for {
+		attempts++
+		err := c.call(ctx, msg, prio)
+		if err == nil {
+			return
+		}
+		if attempts < policy.MaxAttempts && sleepContext(ctx, policy.Backoff(attempts)) {
+			continue
+		}
+		if c.DeadLetter != nil {
+			if dlErr := sendDeadLetter(ctx, c.DeadLetter, c.mq.Name(), msg, prio, attempts, err); dlErr != nil {
+				err = fmt.Errorf("%w; dead-lettering the message failed: %w", err, dlErr)
+			}
+		}
+		c.report(err, msg, prio)
+		return
+	}
+}
+
+// call runs the handler, turning a panic into a *PanicError.
+func (c *Consumer) call(ctx context.Context, msg []byte, prio uint) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &PanicError{Value: v, Stack: debug.Stack()}
+		}
+	}()
+	return c.handler(ctx, msg, prio)
+}
+
+func (c *Consumer) report(err error, msg []byte, prio uint) {
+	if c.OnError != nil {
+		c.OnError(err, msg, prio)
+		return
+	}
+	log.Printf("posix_mq: handling message of priority %d from %s: %s", prio, c.mq.name, err)
+}
+
+// Shutdown stops the consumer from receiving messages and waits for the handlers still running,
+// until ctx is done: their context is cancelled then and Shutdown returns ctx.Err() without waiting further.
+// Calling Shutdown before Run makes Run return right away.
+func (c *Consumer) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	c.stopped = true
+	started, stop, cancelHandlers := c.started, c.stop, c.cancelHandlers
+	c.mu.Unlock()
+	if !started {
+		return nil
+	}
+	stop()
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		cancelHandlers()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,140 @@
+package posix_mq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"syscall"
+	"unicode/utf8"
+)
+
+// Headers of the envelope of a dead letter, the message a Consumer failed to handle as sent to its dead-letter queue.
+// The payload of the envelope is the message as it was received, envelope included if it had one.
+const (
+	HeaderDeadLetterSource   = "dead-letter-source"   // Name of the queue the message was received from
+	HeaderDeadLetterPriority = "dead-letter-priority" // Priority the message was received with
+	HeaderDeadLetterAttempts = "dead-letter-attempts" // Attempts made at handling the message
+	HeaderDeadLetterError    = "dead-letter-error"    // Error of the last attempt
+)
+
+// maxDeadLetterError is the size HeaderDeadLetterError is truncated to, so that a long error leaves room for the message.
+const maxDeadLetterError = 512
+
+// sendDeadLetter sends msg, which failed to be handled after attempts attempts with err last, to dlq.
+// The dead letter keeps the priority of msg, and waits for room on dlq until ctx is done, after which
+// it is only sent if there is room right away.
+// A dead letter larger than the messages of dlq fails with ErrMessageTooLarge without being sent.
+func sendDeadLetter(ctx context.Context, dlq *MessageQueue, source string, msg []byte, prio uint, attempts int, err error) error {
+	m := &Message{
+		Headers: map[string]string{
+			HeaderDeadLetterSource:   source,
+			HeaderDeadLetterPriority: strconv.FormatUint(uint64(prio), 10),
+			HeaderDeadLetterAttempts: strconv.Itoa(attempts),
+			HeaderDeadLetterError:    truncate(err.Error(), maxDeadLetterError),
+		},
+		Priority: prio,
+		Data:     msg,
+	}
+	m.stamp()
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return dlq.opError("encode", err)
+	}
+	if len(data) > dlq.MaxMessageSize() {
+		return dlq.opError("send", fmt.Errorf("dead letter of %d bytes exceeds the message size %d: %w",
+			len(data), dlq.MaxMessageSize(), syscall.EMSGSIZE))
+	}
+	if ctx.Err() != nil {
+		//a consumer out of time for shutting down still dead-letters what fits right away
+		return dlq.opError("send", dlq.sendNow(data, prio))
+	}
+	return dlq.SendContext(ctx, data, prio)
+}
+
+// truncate cuts s to at most n bytes, on a rune boundary, marking the cut with an ellipsis.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	const ellipsis = "..."
+	cut := n - len(ellipsis)
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + ellipsis
+}
+
+// Redrive moves the dead letters queued in mq, a dead-letter queue, back to the queues they were received from,
+// with the payload and priority they were received with, and returns how many were moved.
+// Like DrainTo it only considers the messages queued when it is called, and it does not wait, so mq must be
+// open for reading and writing: a dead letter that cannot be moved, e.g. because its queue is full,
+// is put back into mq and Redrive stops with the error. Messages without dead-letter headers are put back as well.
+func (mq *MessageQueue) Redrive() (int, error) {
+	return mq.redrive(nil)
+}
+
+// RedriveTo is Redrive moving the dead letters to target, whatever queue they were received from.
+func (mq *MessageQueue) RedriveTo(target *MessageQueue) (int, error) {
+	return mq.redrive(target)
+}
+
+var errNotDeadLetter = errors.New("not a dead letter")
+
+func (mq *MessageQueue) redrive(target *MessageQueue) (int, error) {
+	sources := make(map[string]*MessageQueue)
+	defer func() {
+		for _, source := range sources {
+			source.Close()
+		}
+	}()
+
+	//the messages put back are only sent once the drain is over, so that it does not receive them again
+	var (
+		moved   int
+		putBack []memoryMessage
+	)
+	_, err := mq.DrainTo(SinkFunc(func(data []byte, priority uint) error {
+		err := redriveMessage(data, target, sources)
+		if err != nil {
+			putBack = append(putBack, memoryMessage{data: append([]byte{}, data...), priority: priority})
+			if errors.Is(err, errNotDeadLetter) {
+				return nil
+			}
+			return err
+		}
+		moved++
+		return nil
+	}))
+	for _, msg := range putBack {
+		if putErr := mq.sendNow(msg.data, msg.priority); putErr != nil {
+			return moved, errors.Join(err, mq.opError("send", putErr))
+		}
+	}
+	return moved, err
+}
+
+// redriveMessage sends the payload of a dead letter to target, or to its source queue when target is nil,
+// opening the source queues as needed.
+func redriveMessage(data []byte, target *MessageQueue, sources map[string]*MessageQueue) error {
+	var m Message
+	if !IsEnvelope(data) || m.unmarshal(data) != nil {
+		return errNotDeadLetter
+	}
+	source, ok := m.Headers[HeaderDeadLetterSource]
+	prio, err := strconv.ParseUint(m.Headers[HeaderDeadLetterPriority], 10, 32)
+	if !ok || err != nil {
+		return errNotDeadLetter
+	}
+
+	if target == nil {
+		if target = sources[source]; target == nil {
+			target, err = NewMessageQueue(&QueueConfig{Name: source, Flags: O_WRONLY})
+			if err != nil {
+				return err
+			}
+			sources[source] = target
+		}
+	}
+	return target.opError("send", target.sendNow(m.Data, uint(prio)))
+}
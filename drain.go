@@ -0,0 +1,58 @@
+package posix_mq
+
+import (
+	"context"
+	"errors"
+	"syscall"
+)
+
+// MessageSink receives the messages drained from a queue by DrainTo.
+// data is only valid during the call, WriteMessage must copy it to keep it.
+type MessageSink interface {
+	WriteMessage(data []byte, priority uint) error
+}
+
+// SinkFunc adapts a function to a MessageSink, e.g. SinkFunc(other.Send) moves the messages to another queue.
+type SinkFunc func(data []byte, priority uint) error
+
+func (f SinkFunc) WriteMessage(data []byte, priority uint) error {
+	return f(data, priority)
+}
+
+// Purge discards the messages queued when it is called, without waiting even on a blocking queue,
+// and returns how many were discarded, expired messages included. Processes that have the queue open are not disturbed.
+func (mq *MessageQueue) Purge() (int, error) {
+	return mq.DrainTo(SinkFunc(func([]byte, uint) error { return nil }))
+}
+
+// DrainTo receives the messages queued when it is called, without waiting even on a blocking queue,
+// hands them to sink in the order they are received and returns how many were drained.
+// When sink fails DrainTo stops and returns its error, the message handed to sink is consumed nonetheless.
+// On a queue opened with QueueConfig.TTL, messages whose deadline has passed are discarded rather than handed to sink,
+// and counted in the result as they leave the queue all the same.
+func (mq *MessageQueue) DrainTo(sink MessageSink) (int, error) {
+	count, err := mq.Count()
+	if err != nil {
+		return 0, err
+	}
+	buf := mq.recvBufs.Get().(*[]byte)
+	defer mq.recvBufs.Put(buf)
+
+	drained := 0
+	for ; drained < count; drained++ {
+		size, prio, live, err := mq.receiveOnce(context.Background(), *buf, true)
+		if errors.Is(err, syscall.EAGAIN) {
+			break
+		}
+		if err != nil {
+			return drained, mq.opError("receive", err)
+		}
+		if !live {
+			continue
+		}
+		if err := sink.WriteMessage((*buf)[:size], prio); err != nil {
+			return drained + 1, err
+		}
+	}
+	return drained, nil
+}
@@ -0,0 +1,80 @@
+package posix_mq
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Sentinel errors for the conditions callers usually handle, to be checked with errors.Is.
+// The errors returned by posix_mq are *OpError values that match these sentinels,
+// while still unwrapping to the underlying syscall.Errno.
+var (
+	ErrQueueFull       = errors.New("posix_mq: queue is full")
+	ErrQueueEmpty      = errors.New("posix_mq: queue is empty")
+	ErrTimeout         = errors.New("posix_mq: operation timed out")
+	ErrMessageTooLarge = errors.New("posix_mq: message too large")
+	ErrNotFound        = errors.New("posix_mq: queue does not exist")
+	ErrExists          = errors.New("posix_mq: queue already exists")
+	ErrPermission      = errors.New("posix_mq: permission denied")
+	ErrClosed          = errors.New("posix_mq: queue is closed")
+)
+
+// OpError is the error returned by the queue operations.
+// It records the operation that failed, such as "open", "send", "receive", "notify" or "unlink",
+// and the name of the queue it failed on.
+type OpError struct {
+	Op   string
+	Name string
+	Err  error
+}
+
+func (e *OpError) Error() string {
+	return "posix_mq: " + e.Op + " " + e.Name + ": " + e.Err.Error()
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether e matches one of the sentinel errors of the package.
+// EAGAIN means ErrQueueFull when sending and ErrQueueEmpty when receiving.
+func (e *OpError) Is(target error) bool {
+	switch target {
+	case ErrQueueFull:
+		return e.Op == "send" && errors.Is(e.Err, syscall.EAGAIN)
+	case ErrQueueEmpty:
+		return e.Op == "receive" && errors.Is(e.Err, syscall.EAGAIN)
+	case ErrTimeout:
+		return e.Timeout()
+	case ErrMessageTooLarge:
+		return errors.Is(e.Err, syscall.EMSGSIZE)
+	case ErrNotFound:
+		return errors.Is(e.Err, syscall.ENOENT)
+	case ErrExists:
+		return errors.Is(e.Err, syscall.EEXIST)
+	case ErrPermission:
+		return errors.Is(e.Err, syscall.EACCES) || errors.Is(e.Err, syscall.EPERM)
+	case ErrClosed:
+		return errors.Is(e.Err, syscall.EBADF)
+	}
+	return false
+}
+
+// Timeout reports whether the operation ran out of time, be it a timed call, a deadline or a context deadline.
+func (e *OpError) Timeout() bool {
+	return errors.Is(e.Err, syscall.ETIMEDOUT) || errors.Is(e.Err, os.ErrDeadlineExceeded) || errors.Is(e.Err, context.DeadlineExceeded)
+}
+
+// Temporary reports whether retrying the operation later may succeed.
+func (e *OpError) Temporary() bool {
+	return errors.Is(e.Err, syscall.EAGAIN) || errors.Is(e.Err, syscall.EINTR) || e.Timeout()
+}
+
+func (mq *MessageQueue) opError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &OpError{Op: op, Name: mq.name, Err: err}
+}
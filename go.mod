@@ -1,5 +1,5 @@
 module github.com/nidhhoggr/posix_mq
 
-go 1.23
+go 1.24
 
-toolchain go1.23.6
+toolchain go1.24.0
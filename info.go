@@ -0,0 +1,127 @@
+package posix_mq
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Notification methods reported in QueueInfo.NotifyMethod, the sigev_notify of the registration.
+const (
+	NotifySignal = 0 // SIGEV_SIGNAL, see MessageQueue.Notify
+	NotifyNone   = 1 // SIGEV_NONE
+	NotifyThread = 2 // SIGEV_THREAD, see MessageQueue.NotifyChan
+)
+
+// QueueInfo describes a queue as seen on the mqueue filesystem.
+type QueueInfo struct {
+	Name string // Name of the queue, without the leading slash
+	Path string // Path of the queue file
+
+	Size         int64 // QSIZE, total bytes of the queued messages, including the kernel's per message overhead
+	NotifyMethod int   // NOTIFY, meaningful only while NotifyPID is set
+	NotifySigNo  int   // SIGNO, the signal sent by a NotifySignal registration
+	NotifyPID    int   // NOTIFY_PID, the process registered for notification, 0 when there is none
+
+	UID     uint32
+	GID     uint32
+	Mode    fs.FileMode
+	ModTime time.Time
+}
+
+// Notified reports whether a process is registered for notification on the queue.
+func (qi *QueueInfo) Notified() bool {
+	return qi.NotifyPID != 0
+}
+
+// ListQueues returns the queues found in dir, the mqueue filesystem mount point, sorted by name.
+// An empty dir means POSIX_MQ_DIR.
+// Each queue file is read as by Stat, dropping the registrations made by Notify in this process on every queue listed.
+func ListQueues(dir string) ([]QueueInfo, error) {
+	if dir == "" {
+		dir = POSIX_MQ_DIR
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, &OpError{Op: "list", Name: dir, Err: pathError(err)}
+	}
+	queues := make([]QueueInfo, 0, len(entries))
+	for _, entry := range entries {
+		qi, err := statQueue(dir, entry.Name())
+		if err != nil {
+			//the queue was unlinked since the directory was read
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		queues = append(queues, *qi)
+	}
+	return queues, nil
+}
+
+// Stat returns the information of the queue called name in POSIX_MQ_DIR.
+// The leading slash of name is optional.
+// The queue file is opened and read, and closing it drops a registration made by Notify in this process on the queue,
+// as closing any descriptor of the queue does; NotifyChan and NotifyFunc register again by themselves.
+func Stat(name string) (*QueueInfo, error) {
+	return statQueue(POSIX_MQ_DIR, strings.TrimPrefix(name, "/"))
+}
+
+func statQueue(dir, name string) (*QueueInfo, error) {
+	path := strings.TrimSuffix(dir, "/") + "/" + name
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, &OpError{Op: "stat", Name: path, Err: pathError(err)}
+	}
+	qi := &QueueInfo{
+		Name:    name,
+		Path:    path,
+		Mode:    fi.Mode(),
+		ModTime: fi.ModTime(),
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		qi.UID = st.Uid
+		qi.GID = st.Gid
+	}
+
+	//the file reads as a single line such as "QSIZE:129 NOTIFY:2 SIGNO:0 NOTIFY_PID:8260"
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, &OpError{Op: "stat", Name: path, Err: pathError(err)}
+	}
+	for _, field := range strings.Fields(string(content)) {
+		key, value, ok := strings.Cut(field, ":")
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, &OpError{Op: "stat", Name: path, Err: err}
+		}
+		switch key {
+		case "QSIZE":
+			qi.Size = n
+		case "NOTIFY":
+			qi.NotifyMethod = int(n)
+		case "SIGNO":
+			qi.NotifySigNo = int(n)
+		case "NOTIFY_PID":
+			qi.NotifyPID = int(n)
+		}
+	}
+	return qi, nil
+}
+
+// pathError strips the *fs.PathError of err, OpError records the path already.
+func pathError(err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err
+	}
+	return err
+}
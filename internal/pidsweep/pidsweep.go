@@ -0,0 +1,51 @@
+// Package pidsweep removes the queues named after the PID of the process that created them,
+// once that process is gone or at its own request.
+package pidsweep
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/nidhhoggr/posix_mq"
+)
+
+// Sweep removes the queues of POSIX_MQ_DIR named prefix followed by a PID accepted by match, up to the first dot,
+// and returns their names. The directory is only listed: reading the queue files would drop
+// the Notify registrations of this process on them.
+func Sweep(prefix string, match func(pid int) bool) ([]string, error) {
+	entries, err := os.ReadDir(posix_mq.POSIX_MQ_DIR)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, entry := range entries {
+		rest, ok := strings.CutPrefix(entry.Name(), prefix)
+		if !ok {
+			continue
+		}
+		pidStr, _, _ := strings.Cut(rest, ".")
+		pid, err := strconv.Atoi(pidStr)
+		if err != nil || !match(pid) {
+			continue
+		}
+		if err := posix_mq.ForceRemoveQueue(entry.Name()); err != nil && !errors.Is(err, posix_mq.ErrNotFound) {
+			return removed, err
+		}
+		removed = append(removed, entry.Name())
+	}
+	return removed, nil
+}
+
+// ProcessAlive reports whether the process pid exists, it may belong to another user.
+func ProcessAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// Gone reports whether the process pid does not exist anymore, for use with Sweep.
+func Gone(pid int) bool {
+	return !ProcessAlive(pid)
+}
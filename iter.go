@@ -0,0 +1,78 @@
+package posix_mq
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"syscall"
+)
+
+// Messages returns a sequence of the messages received from the queue, opened as by ReceiveMessage,
+// each one waiting for the next message on a blocking queue:
+//
+//	for msg, err := range mq.Messages(ctx) {
+//		...
+//	}
+//
+// The sequence ends when ctx is done or the queue is closed. A message that cannot be decoded is yielded
+// with its error and the sequence goes on, other errors are yielded before it ends, such as
+// ErrQueueEmpty on a non-blocking queue.
+func (mq *MessageQueue) Messages(ctx context.Context) iter.Seq2[Message, error] {
+	return func(yield func(Message, error) bool) {
+		for {
+			m, err := mq.ReceiveMessageContext(ctx)
+			if err != nil {
+				if ctx.Err() != nil || errors.Is(err, ErrClosed) {
+					return
+				}
+				var decodeErr *DecodeError
+				if !yield(Message{}, err) || !errors.As(err, &decodeErr) {
+					return
+				}
+				continue
+			}
+			if !yield(*m, nil) {
+				return
+			}
+		}
+	}
+}
+
+// Drain returns a sequence of the messages in the queue, opened as by ReceiveMessage, that ends once the queue
+// is empty, without waiting even on a blocking queue. The sequence yields at most the number of messages
+// queued when it starts, so that a queue kept busy by producers is drained of a snapshot only;
+// the expired messages it discards count against that number.
+// A message that cannot be decoded is yielded with its error and the sequence goes on,
+// other errors are yielded before it ends.
+func (mq *MessageQueue) Drain() iter.Seq2[Message, error] {
+	return func(yield func(Message, error) bool) {
+		count, err := mq.Count()
+		if err != nil {
+			yield(Message{}, err)
+			return
+		}
+		for ; count > 0; count-- {
+			data, prio, live, err := mq.receiveNow()
+			if errors.Is(err, syscall.EAGAIN) {
+				return
+			}
+			if err != nil {
+				yield(Message{}, mq.opError("receive", err))
+				return
+			}
+			if !live {
+				continue
+			}
+			m, err := mq.openMessage(data, prio)
+			if err != nil {
+				if !yield(Message{}, err) {
+					return
+				}
+				continue
+			}
+			if !yield(*m, nil) {
+				return
+			}
+		}
+	}
+}
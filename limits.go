@@ -0,0 +1,182 @@
+package posix_mq
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// rlimitMsgqueue is RLIMIT_MSGQUEUE, missing from package syscall.
+	rlimitMsgqueue = 0xc
+
+	// Ceilings of msg_max and msgsize_max, also enforced on processes with CAP_SYS_RESOURCE which ignore those.
+	hardMsgMax     = 65536
+	hardMsgSizeMax = MSGSIZE_MAX
+
+	mqPrioMax = 32768 // MQ_PRIO_MAX of the kernel
+
+	//sizes of struct msg_msg and struct posix_msg_tree_node, both six words long
+	msgMsgSize      = 6 * unsafe.Sizeof(uintptr(0))
+	msgTreeNodeSize = 6 * unsafe.Sizeof(uintptr(0))
+
+	capSysResource = 24 // CAP_SYS_RESOURCE
+)
+
+// POSIX_MQ_LIMITS_DIR holds the message queue settings of the system.
+const POSIX_MQ_LIMITS_DIR = "/proc/sys/fs/mqueue/"
+
+// Limits are the message queue limits of the system and of the calling process.
+type Limits struct {
+	MsgMax         int // Max. MaxMsg of a new queue (msg_max)
+	MsgSizeMax     int // Max. MsgSize of a new queue (msgsize_max)
+	QueuesMax      int // Max. # of queues on the system (queues_max)
+	MsgDefault     int // MaxMsg of a queue created without attributes (msg_default)
+	MsgSizeDefault int // MsgSize of a queue created without attributes (msgsize_default)
+
+	// Bytes the queues of the user may consume, see MessageQueueAttribute.Bytes (RLIMIT_MSGQUEUE)
+	RlimitCur uint64
+	RlimitMax uint64
+}
+
+// SystemLimits reads the limits in POSIX_MQ_LIMITS_DIR and the RLIMIT_MSGQUEUE of the process.
+func SystemLimits() (*Limits, error) {
+	limits := &Limits{}
+	for _, setting := range []struct {
+		name  string
+		value *int
+	}{
+		{"msg_max", &limits.MsgMax},
+		{"msgsize_max", &limits.MsgSizeMax},
+		{"queues_max", &limits.QueuesMax},
+		{"msg_default", &limits.MsgDefault},
+		{"msgsize_default", &limits.MsgSizeDefault},
+	} {
+		path := POSIX_MQ_LIMITS_DIR + setting.name
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, &OpError{Op: "limits", Name: path, Err: pathError(err)}
+		}
+		if *setting.value, err = strconv.Atoi(strings.TrimSpace(string(content))); err != nil {
+			return nil, &OpError{Op: "limits", Name: path, Err: err}
+		}
+	}
+
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(rlimitMsgqueue, &rlimit); err != nil {
+		return nil, &OpError{Op: "limits", Name: "RLIMIT_MSGQUEUE", Err: err}
+	}
+	limits.RlimitCur = rlimit.Cur
+	limits.RlimitMax = rlimit.Max
+	return limits, nil
+}
+
+// Bytes returns the bytes a queue with MaxMsg messages of MsgSize bytes is charged against RLIMIT_MSGQUEUE,
+// which covers the kernel's bookkeeping of each message as well as the messages themselves.
+func (attr *MessageQueueAttribute) Bytes() uint64 {
+	maxMsg, msgSize := uint64(attr.MaxMsg), uint64(attr.MsgSize)
+	treeNodes := min(maxMsg, mqPrioMax)
+	return maxMsg*uint64(msgMsgSize) + treeNodes*uint64(msgTreeNodeSize) + maxMsg*msgSize
+}
+
+// LimitError explains which limit made the creation of a queue fail.
+// It wraps the error reported by the system, so the OpError returned by NewMessageQueue still matches it.
+type LimitError struct {
+	Limit     string // msg_max, msgsize_max, queues_max, RLIMIT_MSGQUEUE, or HARD_MSGMAX and HARD_MSGSIZEMAX for privileged processes
+	Requested uint64 // The requested MaxMsg, MsgSize, # of queues or bytes
+	Max       uint64 // The value of the limit
+	Bytes     uint64 // The bytes the queue attributes consume, see MessageQueueAttribute.Bytes
+	Err       error
+}
+
+func (e *LimitError) Error() string {
+	var what string
+	switch e.Limit {
+	case "msg_max", "HARD_MSGMAX":
+		what = "maxmsg"
+	case "msgsize_max", "HARD_MSGSIZEMAX":
+		what = "msgsize"
+	case "queues_max":
+		what = "queue count"
+	default:
+		return fmt.Sprintf("%s: the queue needs %d bytes, exceeding %s %d", e.Err, e.Bytes, e.Limit, e.Max)
+	}
+	return fmt.Sprintf("%s: %s %d exceeds %s %d, the queue needs %d bytes", e.Err, what, e.Requested, e.Limit, e.Max, e.Bytes)
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
+
+// explainOpenError returns a LimitError for err when it was caused by a limit exceeded while creating a queue,
+// otherwise err itself.
+func explainOpenError(config *QueueConfig, err error) error {
+	if config.Flags&O_CREAT == 0 {
+		return err
+	}
+	limits, limitsErr := SystemLimits()
+	if limitsErr != nil {
+		return err
+	}
+	attr := config.Attrs
+	if attr == nil {
+		attr = &MessageQueueAttribute{MaxMsg: limits.MsgDefault, MsgSize: limits.MsgSizeDefault}
+	}
+	privileged := hasCapability(capSysResource)
+	limitErr := &LimitError{Bytes: attr.Bytes(), Err: err}
+
+	switch {
+	case errors.Is(err, syscall.EINVAL):
+		if attr.MaxMsg <= 0 || attr.MsgSize <= 0 {
+			return err
+		}
+		msgMax, msgSizeMax := limits.MsgMax, limits.MsgSizeMax
+		msgMaxName, msgSizeMaxName := "msg_max", "msgsize_max"
+		if privileged {
+			msgMax, msgSizeMax = hardMsgMax, hardMsgSizeMax
+			msgMaxName, msgSizeMaxName = "HARD_MSGMAX", "HARD_MSGSIZEMAX"
+		}
+		if attr.MaxMsg > msgMax {
+			limitErr.Limit, limitErr.Requested, limitErr.Max = msgMaxName, uint64(attr.MaxMsg), uint64(msgMax)
+		} else if attr.MsgSize > msgSizeMax {
+			limitErr.Limit, limitErr.Requested, limitErr.Max = msgSizeMaxName, uint64(attr.MsgSize), uint64(msgSizeMax)
+		} else {
+			return err
+		}
+	case errors.Is(err, syscall.EMFILE):
+		//EMFILE is also the error of running out of file descriptors, only blame the queue when it cannot fit at all
+		if limitErr.Bytes <= limits.RlimitCur {
+			return err
+		}
+		limitErr.Limit, limitErr.Requested, limitErr.Max = "RLIMIT_MSGQUEUE", limitErr.Bytes, limits.RlimitCur
+	case errors.Is(err, syscall.ENOSPC):
+		//counting the entries does not open the queue files, whose closing would drop the Notify registrations
+		entries, readErr := os.ReadDir(POSIX_MQ_DIR)
+		if readErr != nil {
+			return err
+		}
+		limitErr.Limit, limitErr.Requested, limitErr.Max = "queues_max", uint64(len(entries)+1), uint64(limits.QueuesMax)
+	default:
+		return err
+	}
+	return limitErr
+}
+
+// hasCapability reports whether the process holds the effective capability numbered capability.
+func hasCapability(capability uint) bool {
+	content, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if value, ok := strings.CutPrefix(line, "CapEff:"); ok {
+			caps, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+			return err == nil && caps&(1<<capability) != 0
+		}
+	}
+	return false
+}
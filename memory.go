@@ -0,0 +1,312 @@
+package posix_mq
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// Attributes of the memory queues created without Attrs, the kernel defaults of msg_default and msgsize_default.
+	memoryMsgDefault     = 10
+	memoryMsgSizeDefault = 8192
+
+	nameMax = 255 // NAME_MAX
+)
+
+// MemoryQueue is an in-memory stand-in for MessageQueue, for tests that should not depend on /dev/mqueue.
+//
+// Memory queues live in a registry of the process, by name, and are opened with the same QueueConfig as
+// message queues, failing with the same errno: ENOENT, EEXIST, EACCES for an invalid name and EINVAL for
+// attributes beyond the hard limits of the kernel, as sysctl settings do not apply.
+// Sends and receives honour MaxMsg, MsgSize, the priority order, the access mode and O_NONBLOCK as mq_send(3)
+// and mq_receive(3) do. With QueueConfig.TTL the receive calls strip off and honour the deadline of the messages
+// sent with SendWithTTL, as those of MessageQueue do. Config.Mode and Config.Dir are ignored.
+// A MemoryQueue is safe for concurrent use by multiple goroutines.
+type MemoryQueue struct {
+	q        *memoryQueue
+	name     string
+	access   int // O_RDONLY, O_WRONLY or O_RDWR
+	nonblock atomic.Bool
+	closed   atomic.Bool
+	done     chan struct{} // closed by Close to wake up the calls waiting on the queue
+	expiry   expiry        // messages discarded because their deadline had passed, see SendWithTTL
+}
+
+// memoryQueue is the state shared by the MemoryQueue values opened on the same name.
+type memoryQueue struct {
+	maxMsg  int
+	msgSize int
+
+	mu       sync.Mutex
+	messages []memoryMessage // highest priority first, oldest first within a priority
+	changed  chan struct{}   // closed and replaced whenever a message is sent or received
+}
+
+type memoryMessage struct {
+	data     []byte
+	priority uint
+}
+
+var memoryQueues = struct {
+	sync.Mutex
+	queues map[string]*memoryQueue
+}{queues: make(map[string]*memoryQueue)}
+
+// NewMemoryQueue opens the memory queue config.Name, creating it when config.Flags has O_CREAT.
+func NewMemoryQueue(config *QueueConfig) (*MemoryQueue, error) {
+	name := "/" + config.Name
+	q, err := openMemoryQueue(config)
+	if err != nil {
+		return nil, &OpError{Op: "open", Name: name, Err: err}
+	}
+	mq := &MemoryQueue{
+		q:      q,
+		name:   name,
+		access: config.Flags & (O_RDONLY | O_WRONLY | O_RDWR),
+		done:   make(chan struct{}),
+	}
+	mq.nonblock.Store(config.Flags&O_NONBLOCK != 0)
+	mq.expiry.enabled = config.TTL
+	return mq, nil
+}
+
+func openMemoryQueue(config *QueueConfig) (*memoryQueue, error) {
+	switch {
+	case config.Name == "" || strings.Contains(config.Name, "/"):
+		return nil, syscall.EACCES
+	case len(config.Name) > nameMax:
+		return nil, syscall.ENAMETOOLONG
+	case config.Flags&(O_WRONLY|O_RDWR) == O_WRONLY|O_RDWR:
+		return nil, syscall.EINVAL
+	}
+
+	memoryQueues.Lock()
+	defer memoryQueues.Unlock()
+	if q, ok := memoryQueues.queues[config.Name]; ok {
+		if config.Flags&(O_CREAT|O_EXCL) == O_CREAT|O_EXCL {
+			return nil, syscall.EEXIST
+		}
+		return q, nil
+	}
+	if config.Flags&O_CREAT == 0 {
+		return nil, syscall.ENOENT
+	}
+
+	q := &memoryQueue{maxMsg: memoryMsgDefault, msgSize: memoryMsgSizeDefault, changed: make(chan struct{})}
+	if attr := config.Attrs; attr != nil {
+		if attr.MaxMsg <= 0 || attr.MsgSize <= 0 || attr.MaxMsg > hardMsgMax || attr.MsgSize > hardMsgSizeMax {
+			return nil, syscall.EINVAL
+		}
+		q.maxMsg, q.msgSize = attr.MaxMsg, attr.MsgSize
+	}
+	memoryQueues.queues[config.Name] = q
+	return q, nil
+}
+
+// RemoveMemoryQueue removes the memory queue name from the registry, the counterpart of ForceRemoveQueue.
+// The queues already open on it keep working.
+func RemoveMemoryQueue(name string) error {
+	memoryQueues.Lock()
+	defer memoryQueues.Unlock()
+	if _, ok := memoryQueues.queues[name]; !ok {
+		return &OpError{Op: "unlink", Name: name, Err: syscall.ENOENT}
+	}
+	delete(memoryQueues.queues, name)
+	return nil
+}
+
+// Send sends a copy of data to the queue.
+func (mq *MemoryQueue) Send(data []byte, priority uint) error {
+	return mq.opError("send", mq.send(context.Background(), data, priority))
+}
+
+// TimedSend sends data to the queue with a ceiling on the time for which the call will block.
+func (mq *MemoryQueue) TimedSend(data []byte, priority uint, duration time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+	return mq.opError("send", timedOut(mq.send(ctx, data, priority)))
+}
+
+// SendContext sends data to the queue, blocking until there is room on the queue or ctx is done.
+func (mq *MemoryQueue) SendContext(ctx context.Context, data []byte, priority uint) error {
+	return mq.opError("send", mq.send(ctx, data, priority))
+}
+
+func (mq *MemoryQueue) send(ctx context.Context, data []byte, priority uint) error {
+	switch {
+	case mq.closed.Load() || mq.access == O_RDONLY:
+		return syscall.EBADF
+	case len(data) > mq.q.msgSize:
+		return syscall.EMSGSIZE
+	case priority >= mqPrioMax:
+		return syscall.EINVAL
+	}
+	msg := memoryMessage{data: append([]byte{}, data...), priority: priority}
+	return mq.await(ctx, func(q *memoryQueue) bool {
+		if len(q.messages) >= q.maxMsg {
+			return false
+		}
+		//after the messages of the same or a higher priority
+		i := len(q.messages)
+		for i > 0 && q.messages[i-1].priority < priority {
+			i--
+		}
+		q.messages = slices.Insert(q.messages, i, msg)
+		return true
+	})
+}
+
+// Receive receives the oldest message of the highest priority from the queue.
+// With QueueConfig.TTL, like all the receive calls, it strips off the deadline of a message sent with SendWithTTL
+// and discards the messages whose deadline has passed, receiving the next one instead.
+func (mq *MemoryQueue) Receive() ([]byte, uint, error) {
+	msg, prio, err := mq.receive(context.Background())
+	return msg, prio, mq.opError("receive", err)
+}
+
+// TimedReceive receives a message from the queue with a ceiling on the time for which the call will block.
+func (mq *MemoryQueue) TimedReceive(duration time.Duration) ([]byte, uint, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+	msg, prio, err := mq.receive(ctx)
+	return msg, prio, mq.opError("receive", timedOut(err))
+}
+
+// ReceiveContext receives a message from the queue, blocking until a message arrives or ctx is done.
+func (mq *MemoryQueue) ReceiveContext(ctx context.Context) ([]byte, uint, error) {
+	msg, prio, err := mq.receive(ctx)
+	return msg, prio, mq.opError("receive", err)
+}
+
+func (mq *MemoryQueue) receive(ctx context.Context) ([]byte, uint, error) {
+	if mq.closed.Load() || mq.access == O_WRONLY {
+		return nil, 0, syscall.EBADF
+	}
+	for {
+		var msg memoryMessage
+		err := mq.await(ctx, func(q *memoryQueue) bool {
+			if len(q.messages) == 0 {
+				return false
+			}
+			msg = q.messages[0]
+			q.messages = slices.Delete(q.messages, 0, 1)
+			return true
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		//the message is a copy of its own, so its deadline is stripped off in place
+		if size, live := mq.expiry.strip(msg.data, msg.priority); live {
+			return msg.data[:size], msg.priority, nil
+		}
+	}
+}
+
+// await calls try with the queue locked until it reports done, waiting for the queue to change in between,
+// unless the queue is non-blocking, ctx is done or mq is closed.
+func (mq *MemoryQueue) await(ctx context.Context, try func(q *memoryQueue) bool) error {
+	q := mq.q
+	for {
+		if mq.closed.Load() {
+			return syscall.EBADF
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		q.mu.Lock()
+		if try(q) {
+			close(q.changed)
+			q.changed = make(chan struct{})
+			q.mu.Unlock()
+			return nil
+		}
+		changed := q.changed
+		q.mu.Unlock()
+		if mq.nonblock.Load() {
+			return syscall.EAGAIN
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+		case <-mq.done:
+		}
+	}
+}
+
+// Name returns the name of the queue as given in QueueConfig, without the leading slash.
+func (mq *MemoryQueue) Name() string {
+	return mq.name[1:]
+}
+
+// MaxMessageSize returns the largest message the queue accepts.
+func (mq *MemoryQueue) MaxMessageSize() int {
+	return mq.q.msgSize
+}
+
+// GetAttr gets the queue attributes
+func (mq *MemoryQueue) GetAttr() (*MessageQueueAttribute, error) {
+	if mq.closed.Load() {
+		return nil, mq.opError("getattr", syscall.EBADF)
+	}
+	mq.q.mu.Lock()
+	count := len(mq.q.messages)
+	mq.q.mu.Unlock()
+	attr := &MessageQueueAttribute{MaxMsg: mq.q.maxMsg, MsgSize: mq.q.msgSize, MsgCnt: count}
+	setNonblockFlag(attr, mq.nonblock.Load())
+	return attr, nil
+}
+
+// SetNonblocking switches the queue between blocking and non-blocking mode and returns the previous attributes.
+func (mq *MemoryQueue) SetNonblocking(nonblock bool) (*MessageQueueAttribute, error) {
+	if mq.closed.Load() {
+		return nil, mq.opError("setattr", syscall.EBADF)
+	}
+	attr, _ := mq.GetAttr()
+	setNonblockFlag(attr, mq.nonblock.Swap(nonblock))
+	return attr, nil
+}
+
+// Count gets the number of queued messages
+func (mq *MemoryQueue) Count() (int, error) {
+	attr, err := mq.GetAttr()
+	if err != nil {
+		return 0, err
+	}
+	return attr.MsgCnt, nil
+}
+
+// Close closes the queue, the messages stay queued until the queue is unlinked.
+// Calls blocked on the queue are woken up and fail with ErrClosed, as do the calls made after it.
+// Closing a closed queue does nothing.
+func (mq *MemoryQueue) Close() error {
+	if !mq.closed.Swap(true) {
+		close(mq.done)
+	}
+	return nil
+}
+
+// Unlink closes the queue, unless it is closed already, and removes its name from the registry,
+// as mq_unlink(3) does. The other MemoryQueue values open on it keep working.
+func (mq *MemoryQueue) Unlink() error {
+	mq.Close()
+	memoryQueues.Lock()
+	defer memoryQueues.Unlock()
+	if _, ok := memoryQueues.queues[mq.name[1:]]; !ok {
+		return mq.opError("unlink", syscall.ENOENT)
+	}
+	delete(memoryQueues.queues, mq.name[1:])
+	return nil
+}
+
+func (mq *MemoryQueue) opError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &OpError{Op: op, Name: mq.name, Err: err}
+}
@@ -0,0 +1,229 @@
+package posix_mq
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Message is a message with metadata, sent in an envelope by SendMessage and read by ReceiveMessage.
+//
+// The envelope starts with EnvelopeMagic and the version of the format, followed by the length of the header block,
+// the header block and the payload. The header block holds ID, Time, SenderPID, ContentType, TraceParent and Headers
+// in that order, strings and byte counts being uvarint length prefixed and Time being a varint of Unix nanoseconds.
+// Fields added to the format are appended to the header block, where older readers skip them;
+// EnvelopeVersion only changes when the format does so incompatibly.
+type Message struct {
+	ID          string    // Unique ID of the message, generated by SendMessage when empty
+	Time        time.Time // Time the message was sent, set by SendMessage when zero
+	SenderPID   int       // PID of the sender, set by SendMessage when 0
+	ContentType string    // Media type of Data, e.g. application/json
+	TraceParent string    // W3C trace context of the sender
+	Headers     map[string]string
+
+	Priority uint
+	Data     []byte
+
+	// Legacy is set on a message received without an envelope, as sent by Send. Only Priority and Data are set then.
+	Legacy bool
+}
+
+const EnvelopeVersion = 1
+
+// EnvelopeMagic starts every envelope, its first byte is not valid text so that raw messages are unlikely to match.
+var EnvelopeMagic = [4]byte{0x89, 'P', 'M', 'Q'}
+
+var (
+	errEnvelopeTruncated = errors.New("truncated envelope")
+	errEnvelopeVersion   = errors.New("unsupported envelope version")
+)
+
+// SendMessage fills in the ID, Time and SenderPID of m when they are unset, and sends m in an envelope.
+func (mq *MessageQueue) SendMessage(m *Message) error {
+	return mq.SendMessageContext(context.Background(), m)
+}
+
+// SendMessageContext is SendMessage blocking until there is room on the queue or ctx is done.
+func (mq *MessageQueue) SendMessageContext(ctx context.Context, m *Message) error {
+	m.stamp()
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return mq.opError("encode", err)
+	}
+	return mq.SendContext(ctx, data, m.Priority)
+}
+
+// stamp fills in the ID, Time and SenderPID of m when they are unset.
+func (m *Message) stamp() {
+	if m.ID == "" {
+		m.ID = newMessageID()
+	}
+	if m.Time.IsZero() {
+		m.Time = time.Now()
+	}
+	if m.SenderPID == 0 {
+		m.SenderPID = os.Getpid()
+	}
+}
+
+// ReceiveMessage receives a message and opens its envelope.
+// A message sent without envelope is returned with Legacy set, one with a damaged envelope fails with
+// a "decode" OpError wrapping a *DecodeError. Expired messages are discarded as by Receive.
+func (mq *MessageQueue) ReceiveMessage() (*Message, error) {
+	return mq.ReceiveMessageContext(context.Background())
+}
+
+// ReceiveMessageContext is ReceiveMessage blocking until a message arrives or ctx is done.
+func (mq *MessageQueue) ReceiveMessageContext(ctx context.Context) (*Message, error) {
+	data, prio, err := mq.ReceiveContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return mq.openMessage(data, prio)
+}
+
+// openMessage opens the envelope of a received message.
+func (mq *MessageQueue) openMessage(data []byte, prio uint) (*Message, error) {
+	m := &Message{Priority: prio}
+	if !IsEnvelope(data) {
+		m.Data, m.Legacy = data, true
+		return m, nil
+	}
+	if err := m.unmarshal(data); err != nil {
+		return nil, mq.opError("decode", &DecodeError{Data: data, Priority: prio, Err: err})
+	}
+	return m, nil
+}
+
+// IsEnvelope reports whether data starts with EnvelopeMagic.
+func IsEnvelope(data []byte) bool {
+	return len(data) >= len(EnvelopeMagic) && [4]byte(data[:len(EnvelopeMagic)]) == EnvelopeMagic
+}
+
+// MarshalBinary returns m in an envelope. Priority and Legacy are not part of the envelope.
+func (m *Message) MarshalBinary() ([]byte, error) {
+	header := binary.AppendUvarint(nil, uint64(len(m.ID)))
+	header = append(header, m.ID...)
+	var nanos int64
+	if !m.Time.IsZero() {
+		nanos = m.Time.UnixNano()
+	}
+	header = binary.AppendVarint(header, nanos)
+	if m.SenderPID < 0 {
+		return nil, fmt.Errorf("invalid sender PID %d", m.SenderPID)
+	}
+	header = binary.AppendUvarint(header, uint64(m.SenderPID))
+	header = appendString(header, m.ContentType)
+	header = appendString(header, m.TraceParent)
+	header = binary.AppendUvarint(header, uint64(len(m.Headers)))
+	for key, value := range m.Headers {
+		header = appendString(header, key)
+		header = appendString(header, value)
+	}
+
+	data := make([]byte, 0, len(EnvelopeMagic)+1+binary.MaxVarintLen64+len(header)+len(m.Data))
+	data = append(data, EnvelopeMagic[:]...)
+	data = append(data, EnvelopeVersion)
+	data = binary.AppendUvarint(data, uint64(len(header)))
+	data = append(data, header...)
+	return append(data, m.Data...), nil
+}
+
+// UnmarshalBinary reads the envelope in data into m, copying the payload.
+func (m *Message) UnmarshalBinary(data []byte) error {
+	if err := m.unmarshal(data); err != nil {
+		return err
+	}
+	m.Data = append([]byte{}, m.Data...)
+	return nil
+}
+
+// unmarshal reads the envelope in data into m, Data pointing into data.
+func (m *Message) unmarshal(data []byte) error {
+	if !IsEnvelope(data) {
+		return errors.New("missing envelope magic")
+	}
+	data = data[len(EnvelopeMagic):]
+	if len(data) == 0 {
+		return errEnvelopeTruncated
+	}
+	if data[0] != EnvelopeVersion {
+		return fmt.Errorf("%w %d", errEnvelopeVersion, data[0])
+	}
+	headerLen, n := binary.Uvarint(data[1:])
+	if n <= 0 || headerLen > uint64(len(data)-1-n) {
+		return errEnvelopeTruncated
+	}
+	header := envelopeReader(data[1+n : 1+n+int(headerLen)])
+	m.Data = data[1+n+int(headerLen):]
+
+	m.ID = header.string()
+	if nanos := header.varint(); nanos != 0 {
+		m.Time = time.Unix(0, nanos)
+	}
+	m.SenderPID = int(header.uvarint())
+	m.ContentType = header.string()
+	m.TraceParent = header.string()
+	if count := header.uvarint(); count > 0 {
+		m.Headers = make(map[string]string, min(count, uint64(len(header))))
+		for ; count > 0 && header != nil; count-- {
+			key := header.string()
+			m.Headers[key] = header.string()
+		}
+	}
+	if header == nil {
+		return errEnvelopeTruncated
+	}
+	return nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// envelopeReader reads the fields of a header block, becoming nil once it runs out of bytes.
+type envelopeReader []byte
+
+func (r *envelopeReader) uvarint() uint64 {
+	v, n := binary.Uvarint(*r)
+	if n <= 0 {
+		*r = nil
+		return 0
+	}
+	*r = (*r)[n:]
+	return v
+}
+
+func (r *envelopeReader) varint() int64 {
+	v, n := binary.Varint(*r)
+	if n <= 0 {
+		*r = nil
+		return 0
+	}
+	*r = (*r)[n:]
+	return v
+}
+
+func (r *envelopeReader) string() string {
+	size := r.uvarint()
+	if *r == nil || size > uint64(len(*r)) {
+		*r = nil
+		return ""
+	}
+	s := string((*r)[:size])
+	*r = (*r)[size:]
+	return s
+}
+
+// newMessageID returns 16 random bytes in hex.
+func newMessageID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
@@ -1,7 +1,13 @@
 package posix_mq
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -9,10 +15,26 @@ import (
 const Version string = "0.2.1"
 
 // Represents the message queue
+// A MessageQueue is safe for concurrent use by multiple goroutines.
 type MessageQueue struct {
-	handler int
-	name    string
-	recvBuf *receiveBuffer
+	file     *os.File
+	conn     syscall.RawConn
+	name     string
+	nonblock atomic.Bool // O_NONBLOCK as requested by the caller, the descriptor itself is always non-blocking
+	msgSize  int         // mq_msgsize of the queue
+	closed   atomic.Bool
+	recvBufs sync.Pool // *[]byte of msgSize each, so concurrent receives never share a buffer
+
+	expiry expiry // messages discarded because their deadline had passed, see SendWithTTL
+
+	deadlineMu    sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	waiters       map[*waiter]struct{} // the calls waiting on an epoll instance of their own, see await
+
+	// ctx is cancelled by Close to wake up calls waiting on an epoll instance of their own, see await.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // QueueConfig is used to configure an instance of the message queue.
@@ -22,6 +44,10 @@ type QueueConfig struct {
 	Flags int
 	Mode  int // The mode of the message queue, e.g. 0600
 	Attrs *MessageQueueAttribute
+
+	// TTL has the receive calls strip off the deadline of the messages sent with SendWithTTL and discard
+	// the messages whose deadline has passed. Without it every message is received as it was sent.
+	TTL bool
 }
 
 type MessageQueueAttribute struct {
@@ -33,71 +59,455 @@ type MessageQueueAttribute struct {
 
 const POSIX_MQ_DIR = "/dev/mqueue/"
 
+var (
+	MemoryAllocationError = fmt.Errorf("Memory Allocation Error")
+)
+
+// aLongTimeAgo is a deadline that has always passed, used to wake up a goroutine parked in the poller.
+var aLongTimeAgo = time.Unix(1, 0)
+
 // NewMessageQueue returns an instance of the message queue given a QueueConfig.
+//
+// The queue descriptor is always opened with O_NONBLOCK and registered with the Go runtime poller,
+// so blocking operations park the calling goroutine instead of an OS thread.
+// Whether the queue behaves as blocking is still decided by O_NONBLOCK in config.Flags.
+// When creating the queue fails because of a system limit, the OpError wraps a *LimitError explaining it.
 func NewMessageQueue(config *QueueConfig) (*MessageQueue, error) {
 
 	//mq_open checks that the name starts with a slash (/), giving the EINVAL error if it does not
 	name := "/" + config.Name
-	h, err := mq_open(name, config.Flags, config.Mode, config.Attrs)
+	h, err := mq_open(name, config.Flags|O_NONBLOCK, config.Mode, config.Attrs)
 	if err != nil {
-		return nil, err
+		return nil, &OpError{Op: "open", Name: name, Err: explainOpenError(config, err)}
 	}
 
-	msgSize := MSGSIZE_DEFAULT
-	if config.Attrs != nil {
-		msgSize = config.Attrs.MsgSize
+	file := os.NewFile(uintptr(h), name)
+	conn, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, &OpError{Op: "open", Name: name, Err: err}
 	}
-	recvBuf, err := newReceiveBuffer(msgSize)
+
+	//an existing queue keeps the attributes it was created with, whatever config.Attrs says
+	attr, err := mq_getattr(h)
 	if err != nil {
-		return nil, err
+		file.Close()
+		return nil, &OpError{Op: "open", Name: name, Err: err}
 	}
+	msgSize := attr.MsgSize
 
-	return &MessageQueue{
-		handler: h,
+	ctx, cancel := context.WithCancel(context.Background())
+	mq := &MessageQueue{
+		file:    file,
+		conn:    conn,
 		name:    name,
-		recvBuf: recvBuf,
-	}, nil
+		msgSize: msgSize,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	mq.recvBufs.New = func() any {
+		buf := make([]byte, msgSize)
+		return &buf
+	}
+	mq.nonblock.Store(config.Flags&O_NONBLOCK != 0)
+	mq.expiry.enabled = config.TTL
+	//release the descriptor of a queue that is dropped without being closed
+	runtime.SetFinalizer(mq, (*MessageQueue).Close)
+	return mq, nil
 }
 
 // Send sends message to the message queue.
+// data is passed to the kernel as is, without being copied first.
 func (mq *MessageQueue) Send(data []byte, priority uint) error {
-	return mq_send(mq.handler, data, priority)
+	op := mq.newSendOp(data, priority)
+	defer op.release()
+	return mq.opError("send", mq.await(context.Background(), op))
 }
 
 // TimedSend sends message to the message queue with a ceiling on the time for which the call will block.
 func (mq *MessageQueue) TimedSend(data []byte, priority uint, duration time.Duration) error {
-	tDiff := time.Now().Local().Add(duration)
-	return mq_timedsend(mq.handler, data, priority, tDiff)
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+	op := mq.newSendOp(data, priority)
+	defer op.release()
+	return mq.opError("send", timedOut(mq.await(ctx, op)))
+}
+
+// SendContext sends message to the message queue, blocking until there is room on the queue or ctx is done.
+// When ctx is done first the call is woken up and fails with ctx.Err().
+func (mq *MessageQueue) SendContext(ctx context.Context, data []byte, priority uint) error {
+	if err := ctx.Err(); err != nil {
+		return mq.opError("send", err)
+	}
+	op := mq.newSendOp(data, priority)
+	defer op.release()
+	return mq.opError("send", mq.await(ctx, op))
 }
 
 // Receive receives message from the message queue.
+// On a queue opened with QueueConfig.TTL, like all the receive calls, it strips off the deadline of a message
+// sent with SendWithTTL and discards the messages whose deadline has passed, receiving the next one instead.
 func (mq *MessageQueue) Receive() ([]byte, uint, error) {
-	return mq_receive(mq.handler, mq.recvBuf)
+	msg, prio, err := mq.receive(context.Background())
+	return msg, prio, mq.opError("receive", err)
 }
 
 // TimedReceive receives message from the message queue with a ceiling on the time for which the call will block.
+// Expired messages are discarded as by Receive, the call waiting on for a live one.
 func (mq *MessageQueue) TimedReceive(duration time.Duration) ([]byte, uint, error) {
-	tDiff := time.Now().Local().Add(duration)
-	return mq_timedreceive(mq.handler, mq.recvBuf, tDiff)
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+	msg, prio, err := mq.receive(ctx)
+	return msg, prio, mq.opError("receive", timedOut(err))
+}
+
+// ReceiveContext receives message from the message queue, blocking until a message arrives or ctx is done.
+// When ctx is done first the call is woken up and fails with ctx.Err().
+// Expired messages are discarded as by Receive, the call waiting on for a live one.
+func (mq *MessageQueue) ReceiveContext(ctx context.Context) ([]byte, uint, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, mq.opError("receive", err)
+	}
+	msg, prio, err := mq.receive(ctx)
+	return msg, prio, mq.opError("receive", err)
+}
+
+// ReceiveInto receives message from the message queue into buf, returning the size of the message.
+// The kernel writes the message straight into buf, so nothing is allocated or copied.
+// buf must be at least MaxMessageSize bytes long, otherwise syscall.EMSGSIZE is returned.
+// Expired messages are discarded as by Receive; the deadline of a live one is stripped off in buf,
+// and the returned size is that of the payload. Without QueueConfig.TTL buf holds the message as sent.
+func (mq *MessageQueue) ReceiveInto(buf []byte) (int, uint, error) {
+	size, prio, err := mq.receiveInto(context.Background(), buf)
+	return size, prio, mq.opError("receive", err)
+}
+
+func (mq *MessageQueue) receive(ctx context.Context) ([]byte, uint, error) {
+	buf := mq.recvBufs.Get().(*[]byte)
+	defer mq.recvBufs.Put(buf)
+
+	size, prio, err := mq.receiveInto(ctx, *buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	return append([]byte{}, (*buf)[:size]...), prio, nil
+}
+
+func (mq *MessageQueue) receiveInto(ctx context.Context, buf []byte) (int, uint, error) {
+	return mq.receiveOp(ctx, buf, false)
+}
+
+// receiveNow receives a message without waiting, whether the queue is blocking or not,
+// reporting false when its deadline had passed and it was discarded.
+func (mq *MessageQueue) receiveNow() ([]byte, uint, bool, error) {
+	buf := mq.recvBufs.Get().(*[]byte)
+	defer mq.recvBufs.Put(buf)
+
+	size, prio, live, err := mq.receiveOnce(context.Background(), *buf, true)
+	if err != nil || !live {
+		return nil, 0, false, err
+	}
+	return append([]byte{}, (*buf)[:size]...), prio, true, nil
+}
+
+// sendNow sends a message without waiting, whether the queue is blocking or not.
+func (mq *MessageQueue) sendNow(data []byte, priority uint) error {
+	op := mq.newSendOp(data, priority)
+	op.nonblock = true
+	defer op.release()
+	return mq.await(context.Background(), op)
+}
+
+// receiveOp receives a message into buf, stripping its deadline off, and receives the next one
+// as long as the deadline of the message received has passed.
+func (mq *MessageQueue) receiveOp(ctx context.Context, buf []byte, nonblock bool) (int, uint, error) {
+	for {
+		size, prio, live, err := mq.receiveOnce(ctx, buf, nonblock)
+		if err != nil || live {
+			return size, prio, err
+		}
+	}
+}
+
+// receiveOnce receives a message into buf and strips its deadline off,
+// reporting false when the deadline has passed and the message was discarded.
+func (mq *MessageQueue) receiveOnce(ctx context.Context, buf []byte, nonblock bool) (int, uint, bool, error) {
+	op := mq.newReceiveOp(buf)
+	op.nonblock = nonblock
+	defer op.release()
+	if err := mq.await(ctx, op); err != nil {
+		return 0, 0, false, err
+	}
+	size, live := mq.expiry.strip(buf[:op.size], op.prio)
+	return size, op.prio, live, nil
+}
+
+// queueOp carries the arguments and results of a send or receive through the RawConn callbacks.
+// Ops are pooled together with their callback, so a send or a ReceiveInto does not allocate.
+type queueOp struct {
+	mq       *MessageQueue
+	write    bool
+	nonblock bool   // fail with EAGAIN even on a blocking queue
+	data     []byte // the message to send, or the buffer to receive into
+	prio     uint
+	size     int
+	err      error
+	try      func(fd uintptr) bool
+}
+
+var queueOps = sync.Pool{
+	New: func() any {
+		op := &queueOp{}
+		op.try = op.attempt
+		return op
+	},
+}
+
+func (mq *MessageQueue) newSendOp(data []byte, priority uint) *queueOp {
+	op := queueOps.Get().(*queueOp)
+	op.mq, op.write, op.data, op.prio = mq, true, data, priority
+	return op
+}
+
+func (mq *MessageQueue) newReceiveOp(buf []byte) *queueOp {
+	op := queueOps.Get().(*queueOp)
+	op.mq, op.write, op.data = mq, false, buf
+	return op
+}
+
+func (op *queueOp) release() {
+	op.mq, op.data, op.err, op.nonblock = nil, nil, nil, false
+	queueOps.Put(op)
+}
+
+// attempt runs the operation once on the non-blocking descriptor and reports whether it is finished,
+// which is not the case while it would block on a blocking queue.
+func (op *queueOp) attempt(fd uintptr) bool {
+	if op.write {
+		op.err = mq_send(int(fd), op.data, op.prio)
+	} else {
+		op.size, op.prio, op.err = mq_receive(int(fd), op.data)
+	}
+	return op.err != syscall.EAGAIN || op.nonblock || op.mq.nonblock.Load()
+}
+
+// await runs op against the queue descriptor, parking the goroutine in the runtime poller
+// for as long as op would block on a blocking queue.
+//
+// Waiting on the shared descriptor honours the deadlines set with SetDeadline.
+// When ctx can be done, the wait happens on an epoll instance watching the descriptor instead, whose deadline
+// belongs to this call alone, so cancelling ctx wakes up exactly this call; it is given the earliest of
+// the deadline of ctx and that of the queue. The queue descriptor is never duplicated for this,
+// as closing the duplicate would drop the mq_notify registration of the process.
+func (mq *MessageQueue) await(ctx context.Context, op *queueOp) error {
+	if ctx.Done() == nil {
+		if err := rawWait(mq.conn, op.write, op.try); err != nil {
+			return mq.connError(err)
+		}
+		return op.err
+	}
+	//like the poller does for the shared descriptor, fail once the deadline of the queue has passed
+	if d := mq.deadline(op.write); !d.IsZero() && !time.Now().Before(d) {
+		return os.ErrDeadlineExceeded
+	}
+
+	var w *waiter
+	defer func() {
+		if w != nil {
+			w.file.Close()
+		}
+	}()
+	for {
+		var (
+			done      bool
+			newWaiter *os.File
+			waiterErr error
+		)
+		if err := mq.conn.Control(func(fd uintptr) {
+			if done = op.try(fd); !done && w == nil {
+				newWaiter, waiterErr = openWaiter(int(fd), op.write)
+			}
+		}); err != nil {
+			return mq.connError(err)
+		}
+		if done {
+			return op.err
+		}
+		if waiterErr != nil {
+			return waiterErr
+		}
+
+		if w == nil {
+			w = &waiter{file: newWaiter, write: op.write}
+			w.ctxDeadline, _ = ctx.Deadline()
+			mq.addWaiter(w)
+			defer mq.removeWaiter(w)
+			wakeUp := func() {
+				mq.deadlineMu.Lock()
+				defer mq.deadlineMu.Unlock()
+				w.woken = true
+				w.file.SetDeadline(aLongTimeAgo)
+			}
+			defer context.AfterFunc(ctx, wakeUp)()
+			defer context.AfterFunc(mq.ctx, wakeUp)()
+		}
+
+		if err := waitReady(w.file); err != nil {
+			if mq.ctx.Err() != nil {
+				return mq.connError(err)
+			}
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				mq.deadlineMu.Lock()
+				byQueue := w.byQueue
+				mq.deadlineMu.Unlock()
+				if byQueue {
+					return err
+				}
+				//the poller timer can fire just ahead of the context timer
+				return context.DeadlineExceeded
+			}
+			return err
+		}
+	}
+}
+
+// deadline returns the write deadline of the queue when write is set, its read deadline otherwise.
+func (mq *MessageQueue) deadline(write bool) time.Time {
+	mq.deadlineMu.Lock()
+	defer mq.deadlineMu.Unlock()
+	if write {
+		return mq.writeDeadline
+	}
+	return mq.readDeadline
+}
+
+func (mq *MessageQueue) addWaiter(w *waiter) {
+	mq.deadlineMu.Lock()
+	defer mq.deadlineMu.Unlock()
+	if mq.waiters == nil {
+		mq.waiters = make(map[*waiter]struct{})
+	}
+	mq.waiters[w] = struct{}{}
+	if w.write {
+		w.setDeadline(mq.writeDeadline)
+	} else {
+		w.setDeadline(mq.readDeadline)
+	}
+}
+
+func (mq *MessageQueue) removeWaiter(w *waiter) {
+	mq.deadlineMu.Lock()
+	defer mq.deadlineMu.Unlock()
+	delete(mq.waiters, w)
+}
+
+// setDeadlines sets the read and/or write deadline of the queue, for the shared descriptor and the waiters.
+func (mq *MessageQueue) setDeadlines(t time.Time, read, write bool) error {
+	mq.deadlineMu.Lock()
+	defer mq.deadlineMu.Unlock()
+	var err error
+	switch {
+	case read && write:
+		err = mq.file.SetDeadline(t)
+	case read:
+		err = mq.file.SetReadDeadline(t)
+	default:
+		err = mq.file.SetWriteDeadline(t)
+	}
+	if err != nil {
+		return mq.connError(err)
+	}
+	if read {
+		mq.readDeadline = t
+	}
+	if write {
+		mq.writeDeadline = t
+	}
+	for w := range mq.waiters {
+		if (w.write && write) || (!w.write && read) {
+			w.setDeadline(t)
+		}
+	}
+	return nil
+}
+
+// connError translates the poller failing on a closed queue into the errno the C library would report,
+// which matches ErrClosed.
+func (mq *MessageQueue) connError(err error) error {
+	if mq.closed.Load() && !errors.Is(err, os.ErrDeadlineExceeded) {
+		return syscall.EBADF
+	}
+	return err
+}
+
+func rawWait(conn syscall.RawConn, write bool, f func(fd uintptr) bool) error {
+	if write {
+		return conn.Write(f)
+	}
+	return conn.Read(f)
+}
+
+// timedOut reports a context deadline the way mq_timedsend and mq_timedreceive do.
+func timedOut(err error) error {
+	if err == context.DeadlineExceeded {
+		return syscall.ETIMEDOUT
+	}
+	return err
+}
+
+// SetDeadline sets the read and write deadlines of the queue, like net.Conn.SetDeadline.
+// Once a deadline has passed, blocked and future calls fail with os.ErrDeadlineExceeded.
+// The deadlines apply to every call that waits, the timed and context ones as well, e.g. TimedReceive,
+// ReceiveContext, a Consumer or Messages, which stop at the earliest of their own deadline and that of the queue.
+// A zero value for t means the calls will not time out.
+func (mq *MessageQueue) SetDeadline(t time.Time) error {
+	return mq.opError("setdeadline", mq.setDeadlines(t, true, true))
+}
+
+// SetReadDeadline sets the deadline for future and currently blocked receive calls, see SetDeadline.
+func (mq *MessageQueue) SetReadDeadline(t time.Time) error {
+	return mq.opError("setdeadline", mq.setDeadlines(t, true, false))
+}
+
+// SetWriteDeadline sets the deadline for future and currently blocked send calls, see SetDeadline.
+func (mq *MessageQueue) SetWriteDeadline(t time.Time) error {
+	return mq.opError("setdeadline", mq.setDeadlines(t, false, true))
 }
 
 // Notify set signal notification to handle new message
+// The registration is one-shot and must be renewed after each signal, NotifyChan and NotifyFunc do this themselves.
 func (mq *MessageQueue) Notify(sigNo syscall.Signal) error {
-	return mq_notify(mq.handler, int(sigNo))
+	var notifyErr error
+	if err := mq.conn.Control(func(fd uintptr) {
+		notifyErr = mq_notify(int(fd), int(sigNo))
+	}); err != nil {
+		return mq.opError("notify", mq.connError(err))
+	}
+	return mq.opError("notify", notifyErr)
 }
 
 // Close closes the message queue.
+// Calls blocked on the queue are woken up and fail with ErrClosed, as do the calls made after it.
+// Closing a closed queue does nothing.
 func (mq *MessageQueue) Close() error {
-	mq.recvBuf.free()
-	return mq_close(mq.handler)
+	if mq.closed.Swap(true) {
+		return nil
+	}
+	runtime.SetFinalizer(mq, nil)
+	mq.cancel()
+	//closing waits for the calls using the descriptor to return, so none can reach a recycled descriptor
+	return mq.opError("close", mq.file.Close())
 }
 
-// Unlink deletes the message queue.
+// Unlink closes the message queue, unless it is closed already, and deletes it.
 func (mq *MessageQueue) Unlink() error {
 	if err := mq.Close(); err != nil {
 		return err
 	}
-	return mq_unlink(mq.name)
+	return mq.opError("unlink", mq_unlink(mq.name))
 }
 
 // GetFile gets the file on the OS where the queues are stored
@@ -109,15 +519,82 @@ func (config *QueueConfig) GetFile() string {
 	}
 }
 
+// Name returns the name of the queue as given in QueueConfig, without the leading slash.
+func (mq *MessageQueue) Name() string {
+	return mq.name[1:]
+}
+
+// MaxMessageSize returns the largest message the queue accepts, its mq_msgsize.
+// Sending a larger message fails with syscall.EMSGSIZE.
+func (mq *MessageQueue) MaxMessageSize() int {
+	return mq.msgSize
+}
+
 // GetAttr gets the queue attributes
 func (mq *MessageQueue) GetAttr() (*MessageQueueAttribute, error) {
-	return mq_getattr(mq.handler)
+	var (
+		mqa     *MessageQueueAttribute
+		attrErr error
+	)
+	if err := mq.conn.Control(func(fd uintptr) {
+		mqa, attrErr = mq_getattr(int(fd))
+	}); err != nil {
+		return nil, mq.opError("getattr", mq.connError(err))
+	}
+	if attrErr != nil {
+		return nil, mq.opError("getattr", attrErr)
+	}
+	setNonblockFlag(mqa, mq.nonblock.Load())
+	return mqa, nil
+}
+
+// SetAttr sets the queue attributes and returns the previous ones.
+// As with mq_setattr(3) only O_NONBLOCK in attr.Flags is used, switching the queue between blocking and non-blocking mode.
+// Calls already blocked on the queue keep waiting.
+func (mq *MessageQueue) SetAttr(attr *MessageQueueAttribute) (*MessageQueueAttribute, error) {
+	var (
+		mqa         *MessageQueueAttribute
+		wasNonblock bool
+		attrErr     error
+	)
+	if err := mq.conn.Control(func(fd uintptr) {
+		//the descriptor stays non-blocking for the poller, only the mode seen by callers changes
+		mqa, attrErr = mq_setattr(int(fd), &MessageQueueAttribute{Flags: O_NONBLOCK})
+		if attrErr == nil {
+			wasNonblock = mq.nonblock.Swap(attr.Flags&O_NONBLOCK != 0)
+		}
+	}); err != nil {
+		return nil, mq.opError("setattr", mq.connError(err))
+	}
+	if attrErr != nil {
+		return nil, mq.opError("setattr", attrErr)
+	}
+	setNonblockFlag(mqa, wasNonblock)
+	return mqa, nil
+}
+
+// SetNonblocking switches the queue between blocking and non-blocking mode and returns the previous attributes.
+func (mq *MessageQueue) SetNonblocking(nonblock bool) (*MessageQueueAttribute, error) {
+	attr := &MessageQueueAttribute{}
+	setNonblockFlag(attr, nonblock)
+	return mq.SetAttr(attr)
+}
+
+// setNonblockFlag reports the blocking mode the caller asked for rather than the one of the descriptor.
+func setNonblockFlag(attr *MessageQueueAttribute, nonblock bool) {
+	attr.Flags &^= O_NONBLOCK
+	if nonblock {
+		attr.Flags |= O_NONBLOCK
+	}
 }
 
 // Count gets the number of queued messages
 func (mq *MessageQueue) Count() (int, error) {
 	mqa, err := mq.GetAttr()
-	return mqa.MsgCnt, err
+	if err != nil {
+		return 0, err
+	}
+	return mqa.MsgCnt, nil
 }
 
 // ForceRemoveQueue deletes the posix queue by name
@@ -126,9 +603,11 @@ func (mq *MessageQueue) Count() (int, error) {
 func ForceRemoveQueue(name string) error {
 	err := mq_unlink(name)
 	//If the queue has already been closed mq_unlink will return EINVAL leaving the queue file intact
-	if err.(syscall.Errno) == syscall.EINVAL {
-		return os.Remove(POSIX_MQ_DIR + name)
-	} else {
-		return err
+	if errors.Is(err, syscall.EINVAL) {
+		err = os.Remove(POSIX_MQ_DIR + name)
+	}
+	if err != nil {
+		return &OpError{Op: "unlink", Name: name, Err: err}
 	}
+	return nil
 }
@@ -2,12 +2,21 @@ package posix_mq_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/nidhhoggr/posix_mq"
 	"os"
 	"os/signal"
 	"reflect"
+	"runtime"
+	"runtime/pprof"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -18,141 +27,215 @@ const wired = "Narwhals and ice cream"
 
 // Open non-exist queue without O_CREAT will return syscall.ENOENT
 func TestOpenMQWithOutCreatePermission(t *testing.T) {
-	posix_mq.ForceRemoveQueue("pmq_testing_wocp")
-	config := posix_mq.QueueConfig{
-		Name:  "pmq_testing_wocp",
-		Mode:  0660,
-		Flags: posix_mq.O_WRONLY,
-	}
-	mqt, err := posix_mq.NewMessageQueue(&config)
-	assertNil(t, mqt)
-	mqErr, ok := err.(syscall.Errno)
-	assertTrue(t, ok)
-	assertEqual(t, syscall.ENOENT, mqErr)
+	forEachQueueImpl(t, func(t *testing.T, impl queueImpl) {
+		impl.remove("pmq_testing_wocp")
+		config := posix_mq.QueueConfig{
+			Name:  "pmq_testing_wocp",
+			Mode:  0660,
+			Flags: posix_mq.O_WRONLY,
+		}
+		mqt, err := impl.open(&config)
+		assertNil(t, mqt)
+		var mqErr syscall.Errno
+		ok := errors.As(err, &mqErr)
+		assertTrue(t, ok)
+		assertEqual(t, syscall.ENOENT, mqErr)
+	})
 }
 
 // create queue with invalid name will return syscall.EACCES
 func TestOpenMQWithWrongName(t *testing.T) {
-	posix_mq.ForceRemoveQueue("pmq_testing_wn")
-	//the library already prepends a forward slash
-	config := posix_mq.QueueConfig{
-		Name:  "/pmq_testing_wn",
-		Mode:  0660,
-		Flags: posix_mq.O_WRONLY | posix_mq.O_CREAT,
-	}
-	mqt, err := posix_mq.NewMessageQueue(&config)
-	assertNil(t, mqt)
-	assertNotNil(t, err)
-	mqErr, ok := err.(syscall.Errno)
-	assertTrue(t, ok)
-	assertEqual(t, syscall.EACCES, mqErr)
+	forEachQueueImpl(t, func(t *testing.T, impl queueImpl) {
+		impl.remove("pmq_testing_wn")
+		//the library already prepends a forward slash
+		config := posix_mq.QueueConfig{
+			Name:  "/pmq_testing_wn",
+			Mode:  0660,
+			Flags: posix_mq.O_WRONLY | posix_mq.O_CREAT,
+		}
+		mqt, err := impl.open(&config)
+		assertNil(t, mqt)
+		assertNotNil(t, err)
+		var mqErr syscall.Errno
+		ok := errors.As(err, &mqErr)
+		assertTrue(t, ok)
+		assertEqual(t, syscall.EACCES, mqErr)
+	})
 }
 
 func TestOpenMQSuccess(t *testing.T) {
-	posix_mq.ForceRemoveQueue("pmq_testing_opensuccess")
-	config := posix_mq.QueueConfig{
-		Name:  "pmq_testing_opensuccess",
-		Mode:  0660,
-		Flags: posix_mq.O_WRONLY | posix_mq.O_CREAT,
-	}
-	mqt, err := posix_mq.NewMessageQueue(&config)
-	assertNil(t, err)
-	assertNotNil(t, mqt)
-	err = mqt.Unlink()
-	assertNil(t, err)
+	forEachQueueImpl(t, func(t *testing.T, impl queueImpl) {
+		impl.remove("pmq_testing_opensuccess")
+		config := posix_mq.QueueConfig{
+			Name:  "pmq_testing_opensuccess",
+			Mode:  0660,
+			Flags: posix_mq.O_WRONLY | posix_mq.O_CREAT,
+		}
+		mqt, err := impl.open(&config)
+		assertNil(t, err)
+		assertNotNil(t, mqt)
+		err = mqt.Unlink()
+		assertNil(t, err)
+	})
 }
 
 func TestOpenExistMQ(t *testing.T) {
-	posix_mq.ForceRemoveQueue("pmq_testing_openexisting")
-	config := posix_mq.QueueConfig{
-		Name:  "pmq_testing_openexisting",
-		Mode:  0660,
-		Flags: posix_mq.O_WRONLY | posix_mq.O_CREAT,
-	}
-	mqt, err := posix_mq.NewMessageQueue(&config)
-	assertNil(t, err)
-	assertNotNil(t, mqt)
-	mqt2, err := posix_mq.NewMessageQueue(&config)
-	assertNil(t, err)
-	assertNotNil(t, mqt)
-	err = mqt.Unlink()
-	assertNil(t, err)
-	err = mqt2.Unlink()
-	assertNotNil(t, err)
-	assertEqual(t, syscall.ENOENT, err.(syscall.Errno))
+	forEachQueueImpl(t, func(t *testing.T, impl queueImpl) {
+		impl.remove("pmq_testing_openexisting")
+		config := posix_mq.QueueConfig{
+			Name:  "pmq_testing_openexisting",
+			Mode:  0660,
+			Flags: posix_mq.O_WRONLY | posix_mq.O_CREAT,
+		}
+		mqt, err := impl.open(&config)
+		assertNil(t, err)
+		assertNotNil(t, mqt)
+		mqt2, err := impl.open(&config)
+		assertNil(t, err)
+		assertNotNil(t, mqt)
+		err = mqt.Unlink()
+		assertNil(t, err)
+		err = mqt2.Unlink()
+		assertNotNil(t, err)
+		assertEqual(t, syscall.ENOENT, asErrno(err))
+	})
 }
 
 // create a queue with MasMsg larger than /proc/sys/fs/mqueue/msg_max will return syscall.EINVAL
 func TestCreateMQWithMaxMsgOverLimit(t *testing.T) {
-	posix_mq.ForceRemoveQueue("pmq_testing_mmol")
+	forEachQueueImpl(t, func(t *testing.T, impl queueImpl) {
+		impl.remove("pmq_testing_mmol")
+		config := posix_mq.QueueConfig{
+			Name:  "pmq_testing_mmol",
+			Mode:  0660,
+			Flags: posix_mq.O_WRONLY | posix_mq.O_CREAT,
+			Attrs: &posix_mq.MessageQueueAttribute{
+				MaxMsg: 1000000,
+			},
+		}
+		mqt, err := impl.open(&config)
+		assertNil(t, mqt)
+		assertNotNil(t, err)
+		assertEqual(t, syscall.EINVAL, asErrno(err))
+	})
+}
+
+func Test_SystemLimits(t *testing.T) {
+	limits, err := posix_mq.SystemLimits()
+	assertNil(t, err)
+	content, err := os.ReadFile(posix_mq.POSIX_MQ_LIMITS_DIR + "msg_max")
+	assertNil(t, err)
+	assertEqual(t, strings.TrimSpace(string(content)), strconv.Itoa(limits.MsgMax))
+	assertTrue(t, limits.MsgSizeMax > 0 && limits.QueuesMax > 0)
+	assertTrue(t, limits.MsgDefault > 0 && limits.MsgSizeDefault > 0)
+	assertTrue(t, limits.RlimitCur <= limits.RlimitMax)
+
+	//message headers and priority tree nodes of 48 bytes each on 64 bit
+	attr := &posix_mq.MessageQueueAttribute{MaxMsg: 10, MsgSize: 8192}
+	if unsafe.Sizeof(uintptr(0)) == 8 {
+		assertEqual(t, uint64(10*48+10*48+10*8192), attr.Bytes())
+	}
+}
+
+// a queue that can not be created within the limits fails with an explanation
+func TestCreateMQExplainsLimit(t *testing.T) {
+	posix_mq.ForceRemoveQueue("pmq_testing_limit")
 	config := posix_mq.QueueConfig{
-		Name:  "pmq_testing_mmol",
+		Name:  "pmq_testing_limit",
 		Mode:  0660,
-		Flags: posix_mq.O_WRONLY | posix_mq.O_CREAT,
+		Flags: posix_mq.O_RDWR | posix_mq.O_CREAT,
 		Attrs: &posix_mq.MessageQueueAttribute{
-			MaxMsg: 1000000,
+			MaxMsg:  1000000,
+			MsgSize: 128,
 		},
 	}
-	mqt, err := posix_mq.NewMessageQueue(&config)
-	assertNil(t, mqt)
-	assertNotNil(t, err)
-	assertEqual(t, syscall.EINVAL, err.(syscall.Errno))
+	_, err := posix_mq.NewMessageQueue(&config)
+	assertEqual(t, syscall.EINVAL, asErrno(err))
+	var limitErr *posix_mq.LimitError
+	assertTrue(t, errors.As(err, &limitErr))
+	assertTrue(t, limitErr.Limit == "msg_max" || limitErr.Limit == "HARD_MSGMAX")
+	assertEqual(t, uint64(1000000), limitErr.Requested)
+	assertEqual(t, config.Attrs.Bytes(), limitErr.Bytes)
+
+	//the queue bytes are checked against RLIMIT_MSGQUEUE, even for privileged processes
+	const rlimitMsgqueue = 0xc
+	var rlimit syscall.Rlimit
+	assertNil(t, syscall.Getrlimit(rlimitMsgqueue, &rlimit))
+	lowered := rlimit
+	lowered.Cur = 1024
+	assertNil(t, syscall.Setrlimit(rlimitMsgqueue, &lowered))
+	defer syscall.Setrlimit(rlimitMsgqueue, &rlimit)
+
+	config.Attrs = &posix_mq.MessageQueueAttribute{MaxMsg: 4, MsgSize: 1024}
+	_, err = posix_mq.NewMessageQueue(&config)
+	assertEqual(t, syscall.EMFILE, asErrno(err))
+	assertTrue(t, errors.As(err, &limitErr))
+	assertEqual(t, "RLIMIT_MSGQUEUE", limitErr.Limit)
+	assertEqual(t, uint64(1024), limitErr.Max)
+	assertEqual(t, config.Attrs.Bytes(), limitErr.Requested)
+	assertTrue(t, strings.Contains(err.Error(), "RLIMIT_MSGQUEUE"))
 }
 
 // creat an exist queue with O_EXCL will return syscall.ENINVAL
 func TestExamQueueExist(t *testing.T) {
-	posix_mq.ForceRemoveQueue("pmq_testing_openexcl")
-	config := posix_mq.QueueConfig{
-		Name:  "pmq_testing_openexcl",
-		Mode:  0660,
-		Flags: posix_mq.O_WRONLY | posix_mq.O_CREAT,
-	}
-	mqt, err := posix_mq.NewMessageQueue(&config)
-	assertNil(t, err)
-	assertNotNil(t, mqt)
-	config.Flags = posix_mq.O_WRONLY | posix_mq.O_CREAT | posix_mq.O_EXCL
-	mqt2, err := posix_mq.NewMessageQueue(&config)
-	assertNotNil(t, err)
-	assertNil(t, mqt2)
-	assertEqual(t, syscall.EEXIST, err.(syscall.Errno))
-	err = mqt.Unlink()
-	assertNil(t, err)
+	forEachQueueImpl(t, func(t *testing.T, impl queueImpl) {
+		impl.remove("pmq_testing_openexcl")
+		config := posix_mq.QueueConfig{
+			Name:  "pmq_testing_openexcl",
+			Mode:  0660,
+			Flags: posix_mq.O_WRONLY | posix_mq.O_CREAT,
+		}
+		mqt, err := impl.open(&config)
+		assertNil(t, err)
+		assertNotNil(t, mqt)
+		config.Flags = posix_mq.O_WRONLY | posix_mq.O_CREAT | posix_mq.O_EXCL
+		mqt2, err := impl.open(&config)
+		assertNotNil(t, err)
+		assertNil(t, mqt2)
+		assertEqual(t, syscall.EEXIST, asErrno(err))
+		err = mqt.Unlink()
+		assertNil(t, err)
+	})
 }
 
 func Test_SendMessage(t *testing.T) {
-	mqt := SampleMessageQueue(t, 0, "sendmsg")
+	forEachQueueImpl(t, func(t *testing.T, impl queueImpl) {
+		mqt := sampleQueue(t, impl, 0, "sendmsg")
 
-	for i := 1; i <= 5; i++ {
-		err := mqt.Send([]byte(wired), 0)
-		assertNil(t, err)
-	}
+		for i := 1; i <= 5; i++ {
+			err := mqt.Send([]byte(wired), 0)
+			assertNil(t, err)
+		}
 
-	err := mqt.Unlink()
-	assertNil(t, err)
+		err := mqt.Unlink()
+		assertNil(t, err)
+	})
 }
 
 func Test_SendReceiveMessage(t *testing.T) {
-	mqt := SampleMessageQueue(t, posix_mq.O_WRONLY|posix_mq.O_CREAT, "sendrcvmsg")
-	mqt2 := SampleMessageQueue(t, posix_mq.O_RDONLY|posix_mq.O_CREAT, "sendrcvmsg")
-	for i := 1; i <= 5; i++ {
-		err := mqt.Send([]byte(wired), 0)
-		assertNil(t, err)
-		response, _, err := mqt2.Receive()
-
-		if err != nil {
-			t.Error(err)
-		}
+	forEachQueueImpl(t, func(t *testing.T, impl queueImpl) {
+		mqt := sampleQueue(t, impl, posix_mq.O_WRONLY|posix_mq.O_CREAT, "sendrcvmsg")
+		mqt2 := sampleQueue(t, impl, posix_mq.O_RDONLY|posix_mq.O_CREAT, "sendrcvmsg")
+		for i := 1; i <= 5; i++ {
+			err := mqt.Send([]byte(wired), 0)
+			assertNil(t, err)
+			response, _, err := mqt2.Receive()
+
+			if err != nil {
+				t.Error(err)
+			}
 
-		if wired != string(response) {
-			t.Errorf("expected %s, got: %s", wired, response)
+			if wired != string(response) {
+				t.Errorf("expected %s, got: %s", wired, response)
+			}
 		}
-	}
 
-	err := mqt.Unlink()
-	assertNil(t, err)
-	err = mqt2.Unlink()
-	assertNotNil(t, err)
-	assertEqual(t, syscall.ENOENT, err.(syscall.Errno))
+		err := mqt.Unlink()
+		assertNil(t, err)
+		err = mqt2.Unlink()
+		assertNotNil(t, err)
+		assertEqual(t, syscall.ENOENT, asErrno(err))
+	})
 }
 
 type TestMsg struct {
@@ -163,28 +246,30 @@ type TestMsg struct {
 
 // Send msg size larger than /proc/sys/fs/mqueue/msgsize_max wll return syscall.EMSGSIZE
 func TestSendMsgTooLong(t *testing.T) {
-	posix_mq.ForceRemoveQueue("pmq_testing_mtl")
-	msgSize := int(unsafe.Sizeof(TestMsg{}))
-	config := posix_mq.QueueConfig{
-		Name:  "pmq_testing_mtl",
-		Mode:  0660,
-		Flags: posix_mq.O_WRONLY | posix_mq.O_CREAT,
-		Attrs: &posix_mq.MessageQueueAttribute{
-			MaxMsg:  10,
-			MsgSize: msgSize - 1,
-		},
-	}
-	mqt, err := posix_mq.NewMessageQueue(&config)
-	assertNil(t, err)
-	assertNotNil(t, mqt)
-	buf := bytes.NewBuffer(make([]byte, msgSize))
-	err = binary.Write(buf, binary.LittleEndian, TestMsg{})
-	assertNil(t, err)
-	err = mqt.Send(buf.Bytes(), 0)
-	assertNotNil(t, err)
-	assertEqual(t, syscall.EMSGSIZE, err.(syscall.Errno))
-	err = mqt.Unlink()
-	assertNil(t, err)
+	forEachQueueImpl(t, func(t *testing.T, impl queueImpl) {
+		impl.remove("pmq_testing_mtl")
+		msgSize := int(unsafe.Sizeof(TestMsg{}))
+		config := posix_mq.QueueConfig{
+			Name:  "pmq_testing_mtl",
+			Mode:  0660,
+			Flags: posix_mq.O_WRONLY | posix_mq.O_CREAT,
+			Attrs: &posix_mq.MessageQueueAttribute{
+				MaxMsg:  10,
+				MsgSize: msgSize - 1,
+			},
+		}
+		mqt, err := impl.open(&config)
+		assertNil(t, err)
+		assertNotNil(t, mqt)
+		buf := bytes.NewBuffer(make([]byte, msgSize))
+		err = binary.Write(buf, binary.LittleEndian, TestMsg{})
+		assertNil(t, err)
+		err = mqt.Send(buf.Bytes(), 0)
+		assertNotNil(t, err)
+		assertEqual(t, syscall.EMSGSIZE, asErrno(err))
+		err = mqt.Unlink()
+		assertNil(t, err)
+	})
 }
 
 type TestMsg2 struct {
@@ -193,7 +278,7 @@ type TestMsg2 struct {
 	Data   [21]byte
 }
 
-// recv msg size smaller than MsgSize, receive() return syscall.EMSGSIZE
+// opening an existing queue with a smaller MsgSize, receive() still sizes its buffer from the queue
 func TestRecvMsgTooShort(t *testing.T) {
 	posix_mq.ForceRemoveQueue("pmq_testing_mts")
 	msgSize := int(unsafe.Sizeof(TestMsg2{}))
@@ -221,6 +306,7 @@ func TestRecvMsgTooShort(t *testing.T) {
 	mqt2, err := posix_mq.NewMessageQueue(&config2)
 	assertNil(t, err)
 	assertNotNil(t, mqt2)
+	assertEqual(t, msgSize, mqt2.MaxMessageSize())
 	buf := bytes.NewBuffer(make([]byte, msgSize))
 	msg := TestMsg2{
 		Type: uint8(10),
@@ -228,26 +314,121 @@ func TestRecvMsgTooShort(t *testing.T) {
 	buf.Reset()
 	err = binary.Write(buf, binary.LittleEndian, msg)
 	assertNil(t, err)
-	err = mqt.Send(buf.Bytes(), 0)
+	err = mqt.Send(buf.Bytes(), 1)
 	assertNil(t, err)
 	recvMsg, prio, err := mqt2.Receive()
-	assertEqual(t, 0, len(recvMsg))
+	assertNil(t, err)
+	assertTrue(t, bytes.Equal(buf.Bytes(), recvMsg))
+	assertEqual(t, uint(1), prio)
+	//a caller-owned buffer sized from config2 is still too small
+	err = mqt.Send(buf.Bytes(), 0)
+	assertNil(t, err)
+	n, prio, err := mqt2.ReceiveInto(make([]byte, config2.Attrs.MsgSize))
+	assertEqual(t, 0, n)
 	assertNotNil(t, err)
-	assertEqual(t, syscall.EMSGSIZE, err.(syscall.Errno))
+	assertEqual(t, syscall.EMSGSIZE, asErrno(err))
 	assertEqual(t, uint(0), prio)
 	err = mqt.Unlink()
 	assertNil(t, err)
 	err = mqt2.Unlink()
 	assertNotNil(t, err)
-	assertEqual(t, syscall.ENOENT, err.(syscall.Errno))
+	assertEqual(t, syscall.ENOENT, asErrno(err))
 }
 
 // with non-blocking queue, while queue full, send() will return syscall.EAGAIN
 func TestSendwithNonblocking(t *testing.T) {
-	posix_mq.ForceRemoveQueue("pmq_testing_sendwnblk")
+	forEachQueueImpl(t, func(t *testing.T, impl queueImpl) {
+		impl.remove("pmq_testing_sendwnblk")
+		msgSize := int(unsafe.Sizeof(TestMsg2{}))
+		config := posix_mq.QueueConfig{
+			Name:  "pmq_testing_sendwnblk",
+			Mode:  0660,
+			Flags: posix_mq.O_WRONLY | posix_mq.O_CREAT | posix_mq.O_NONBLOCK,
+			Attrs: &posix_mq.MessageQueueAttribute{
+				MaxMsg:  1,
+				MsgSize: msgSize,
+			},
+		}
+		mqt, err := impl.open(&config)
+		assertNil(t, err)
+		assertNotNil(t, mqt)
+		buf := bytes.NewBuffer(make([]byte, msgSize))
+		buf.Reset()
+		err = binary.Write(buf, binary.LittleEndian, TestMsg2{Type: uint8(1)})
+		assertNil(t, err)
+		err = mqt.Send(buf.Bytes(), 0)
+		assertNil(t, err)
+		buf.Reset()
+		err = binary.Write(buf, binary.LittleEndian, TestMsg2{Type: uint8(2)})
+		assertNil(t, err)
+		err = mqt.Send(buf.Bytes(), 1)
+		assertNotNil(t, err)
+		assertEqual(t, syscall.EAGAIN, asErrno(err))
+		err = mqt.Unlink()
+		assertNil(t, err)
+	})
+}
+
+func TestRecvwithNonblocking(t *testing.T) {
+	forEachQueueImpl(t, func(t *testing.T, impl queueImpl) {
+		impl.remove("pmq_testing_recvwnblk")
+		msgSize := int(unsafe.Sizeof(TestMsg2{}))
+		config := posix_mq.QueueConfig{
+			Name:  "pmq_testing_recvwnblk",
+			Mode:  0660,
+			Flags: posix_mq.O_RDONLY | posix_mq.O_CREAT | posix_mq.O_NONBLOCK,
+			Attrs: &posix_mq.MessageQueueAttribute{
+				MaxMsg:  1,
+				MsgSize: msgSize,
+			},
+		}
+		mqt, err := impl.open(&config)
+		assertNil(t, err)
+		assertNotNil(t, mqt)
+
+		msg, prio, err := mqt.Receive()
+		assertNotNil(t, err)
+		assertEqual(t, uint(0), prio)
+		assertEqual(t, 0, len(msg))
+		assertEqual(t, syscall.EAGAIN, asErrno(err))
+		err = mqt.Unlink()
+		assertNil(t, err)
+	})
+}
+
+// switching a live queue to non-blocking mode makes receive() return syscall.EAGAIN instead of waiting
+func TestSetNonblockingRecv(t *testing.T) {
+	mqt := SampleMessageQueue(t, 0, "setnblkrecv")
+
+	old, err := mqt.SetNonblocking(true)
+	assertNil(t, err)
+	assertEqual(t, 0, old.Flags&posix_mq.O_NONBLOCK)
+	attr, err := mqt.GetAttr()
+	assertNil(t, err)
+	assertEqual(t, posix_mq.O_NONBLOCK, attr.Flags&posix_mq.O_NONBLOCK)
+	msg, prio, err := mqt.Receive()
+	assertNotNil(t, err)
+	assertEqual(t, uint(0), prio)
+	assertEqual(t, 0, len(msg))
+	assertEqual(t, syscall.EAGAIN, asErrno(err))
+
+	old, err = mqt.SetAttr(&posix_mq.MessageQueueAttribute{})
+	assertNil(t, err)
+	assertEqual(t, posix_mq.O_NONBLOCK, old.Flags&posix_mq.O_NONBLOCK)
+	_, _, err = mqt.TimedReceive(100 * time.Millisecond)
+	assertNotNil(t, err)
+	assertEqual(t, syscall.ETIMEDOUT, asErrno(err))
+
+	err = mqt.Unlink()
+	assertNil(t, err)
+}
+
+// switching a full non-blocking queue to blocking mode makes send() wait instead of returning syscall.EAGAIN
+func TestSetNonblockingSend(t *testing.T) {
+	posix_mq.ForceRemoveQueue("pmq_testing_setnblksend")
 	msgSize := int(unsafe.Sizeof(TestMsg2{}))
 	config := posix_mq.QueueConfig{
-		Name:  "pmq_testing_sendwnblk",
+		Name:  "pmq_testing_setnblksend",
 		Mode:  0660,
 		Flags: posix_mq.O_WRONLY | posix_mq.O_CREAT | posix_mq.O_NONBLOCK,
 		Attrs: &posix_mq.MessageQueueAttribute{
@@ -264,130 +445,1320 @@ func TestSendwithNonblocking(t *testing.T) {
 	assertNil(t, err)
 	err = mqt.Send(buf.Bytes(), 0)
 	assertNil(t, err)
-	buf.Reset()
-	err = binary.Write(buf, binary.LittleEndian, TestMsg2{Type: uint8(2)})
+	err = mqt.Send(buf.Bytes(), 0)
+	assertNotNil(t, err)
+	assertEqual(t, syscall.EAGAIN, asErrno(err))
+
+	old, err := mqt.SetNonblocking(false)
 	assertNil(t, err)
-	err = mqt.Send(buf.Bytes(), 1)
+	assertEqual(t, posix_mq.O_NONBLOCK, old.Flags&posix_mq.O_NONBLOCK)
+	assertEqual(t, 1, old.MaxMsg)
+	assertEqual(t, msgSize, old.MsgSize)
+	assertEqual(t, 1, old.MsgCnt)
+	err = mqt.TimedSend(buf.Bytes(), 0, 100*time.Millisecond)
+	assertNotNil(t, err)
+	assertEqual(t, syscall.ETIMEDOUT, asErrno(err))
+
+	old, err = mqt.SetNonblocking(true)
+	assertNil(t, err)
+	assertEqual(t, 0, old.Flags&posix_mq.O_NONBLOCK)
+	err = mqt.TimedSend(buf.Bytes(), 0, 100*time.Millisecond)
 	assertNotNil(t, err)
-	assertEqual(t, syscall.EAGAIN, err.(syscall.Errno))
+	assertEqual(t, syscall.EAGAIN, asErrno(err))
+
 	err = mqt.Unlink()
 	assertNil(t, err)
 }
 
-func TestRecvwithNonblocking(t *testing.T) {
-	posix_mq.ForceRemoveQueue("pmq_testing_recvwnblk")
-	msgSize := int(unsafe.Sizeof(TestMsg2{}))
+func Test_SendReceiveContext(t *testing.T) {
+	mq := SampleMessageQueue(t, 0, "sendrcvctx")
+
+	err := mq.SendContext(context.Background(), []byte(wired), 2)
+	assertNil(t, err)
+	msg, prio, err := mq.ReceiveContext(context.Background())
+	assertNil(t, err)
+	assertEqual(t, wired, string(msg))
+	assertEqual(t, uint(2), prio)
+
+	err = mq.Unlink()
+	assertNil(t, err)
+}
+
+// a cancelled context wakes up a receive blocked on an empty queue
+func Test_ReceiveContextCancel(t *testing.T) {
+	mq := SampleMessageQueue(t, 0, "rcvctxcancel")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	msg, _, err := mq.ReceiveContext(ctx)
+	assertNil(t, msg)
+	assertTrue(t, errors.Is(err, context.Canceled))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected cancellation to wake up the receive, took: %s", elapsed)
+	}
+
+	_, _, err = mq.ReceiveContext(ctx)
+	assertTrue(t, errors.Is(err, context.Canceled))
+
+	err = mq.Unlink()
+	assertNil(t, err)
+}
+
+// a context deadline wakes up a send blocked on a full queue
+func Test_SendContextDeadline(t *testing.T) {
+	posix_mq.ForceRemoveQueue("pmq_testing_sendctxdl")
 	config := posix_mq.QueueConfig{
-		Name:  "pmq_testing_recvwnblk",
+		Name:  "pmq_testing_sendctxdl",
 		Mode:  0660,
-		Flags: posix_mq.O_RDONLY | posix_mq.O_CREAT | posix_mq.O_NONBLOCK,
+		Flags: posix_mq.O_RDWR | posix_mq.O_CREAT,
 		Attrs: &posix_mq.MessageQueueAttribute{
 			MaxMsg:  1,
-			MsgSize: msgSize,
+			MsgSize: len(wired),
 		},
 	}
-	mqt, err := posix_mq.NewMessageQueue(&config)
+	mq, err := posix_mq.NewMessageQueue(&config)
 	assertNil(t, err)
-	assertNotNil(t, mqt)
+	assertNotNil(t, mq)
 
-	msg, prio, err := mqt.Receive()
-	assertNotNil(t, err)
-	assertEqual(t, uint(0), prio)
-	assertEqual(t, 0, len(msg))
-	assertEqual(t, syscall.EAGAIN, err.(syscall.Errno))
-	err = mqt.Unlink()
+	err = mq.Send([]byte(wired), 0)
+	assertNil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = mq.SendContext(ctx, []byte(wired), 0)
+	assertTrue(t, errors.Is(err, context.DeadlineExceeded))
+
+	//room on the queue lets a blocked send through
+	received := make(chan error)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_, _, err := mq.Receive()
+		received <- err
+	}()
+	err = mq.SendContext(context.Background(), []byte(wired), 0)
+	assertNil(t, err)
+	assertNil(t, <-received)
+
+	err = mq.Unlink()
 	assertNil(t, err)
 }
 
-func Test_QueuePriority(t *testing.T) {
-	mq := SampleMessageQueue(t, 0, "qprio")
+func Test_TimedReceive(t *testing.T) {
+	forEachQueueImpl(t, func(t *testing.T, impl queueImpl) {
+		mq := sampleQueue(t, impl, 0, "timedrcv")
 
-	err := mq.Send([]byte(wired), 3)
+		msg, _, err := mq.TimedReceive(100 * time.Millisecond)
+		assertNil(t, msg)
+		assertEqual(t, syscall.ETIMEDOUT, asErrno(err))
 
-	if err != nil {
-		t.Error(err)
-	}
+		err = mq.TimedSend([]byte(wired), 1, 100*time.Millisecond)
+		assertNil(t, err)
+		msg, prio, err := mq.TimedReceive(100 * time.Millisecond)
+		assertNil(t, err)
+		assertEqual(t, wired, string(msg))
+		assertEqual(t, uint(1), prio)
 
-	_, mtype, err := mq.Receive()
+		err = mq.Unlink()
+		assertNil(t, err)
+	})
+}
 
-	if err != nil {
-		t.Error(err)
-	}
+// deadlines apply to blocking calls the way they do for a net.Conn
+func Test_ReadDeadline(t *testing.T) {
+	mq := SampleMessageQueue(t, 0, "rddl")
 
-	if mtype != 3 {
-		t.Errorf("expected mtype 3, got: %d", mtype)
-	}
+	err := mq.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	assertNil(t, err)
+	_, _, err = mq.Receive()
+	assertTrue(t, errors.Is(err, os.ErrDeadlineExceeded))
+
+	err = mq.SetReadDeadline(time.Time{})
+	assertNil(t, err)
+	err = mq.Send([]byte(wired), 0)
+	assertNil(t, err)
+	msg, _, err := mq.Receive()
+	assertNil(t, err)
+	assertEqual(t, wired, string(msg))
 
 	err = mq.Unlink()
 	assertNil(t, err)
 }
 
-func Test_QueueCount(t *testing.T) {
-	mq := SampleMessageQueue(t, 0, "qcnt")
-
-	if err := mq.Send([]byte(wired), 0); err != nil {
-		t.Error(err)
+// the deadlines of the queue also bound the timed and context calls, which stop at the earliest deadline
+func Test_DeadlineTimedAndContext(t *testing.T) {
+	posix_mq.ForceRemoveQueue("pmq_testing_ctxdl")
+	mq := SampleMessageQueue(t, 0, "ctxdl")
+	defer mq.Unlink()
+
+	assertNil(t, mq.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	start := time.Now()
+	_, _, err := mq.TimedReceive(2 * time.Second)
+	assertTrue(t, errors.Is(err, os.ErrDeadlineExceeded))
+	assertTrue(t, time.Since(start) < time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, _, err = mq.ReceiveContext(ctx)
+	assertTrue(t, errors.Is(err, os.ErrDeadlineExceeded))
+	assertTrue(t, time.Since(start) < time.Second)
+
+	//a deadline set while a call is blocked applies to it
+	assertNil(t, mq.SetReadDeadline(time.Time{}))
+	errs := make(chan error)
+	go func() {
+		_, _, err := mq.ReceiveContext(ctx)
+		errs <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	assertNil(t, mq.SetReadDeadline(time.Now().Add(20*time.Millisecond)))
+	select {
+	case err = <-errs:
+		assertTrue(t, errors.Is(err, os.ErrDeadlineExceeded))
+	case <-time.After(time.Second):
+		t.Fatal("expected the blocked receive to time out")
 	}
 
-	if err := mq.Send([]byte(wired), 0); err != nil {
-		t.Error(err)
-	}
+	//the deadline of the call applies when it is the earliest
+	assertNil(t, mq.SetReadDeadline(time.Now().Add(time.Hour)))
+	_, _, err = mq.TimedReceive(20 * time.Millisecond)
+	assertEqual(t, syscall.ETIMEDOUT, asErrno(err))
+	assertNil(t, mq.SetReadDeadline(time.Time{}))
 
-	if count, _ := mq.Count(); count != 2 {
-		t.Errorf("expected count 2, got: %d", count)
+	//write deadlines bound the sends waiting for room
+	attr, err := mq.GetAttr()
+	assertNil(t, err)
+	for i := 0; i < attr.MaxMsg; i++ {
+		assertNil(t, mq.Send([]byte(wired), 0))
 	}
+	assertNil(t, mq.SetWriteDeadline(time.Now().Add(20*time.Millisecond)))
+	err = mq.SendContext(ctx, []byte(wired), 0)
+	assertTrue(t, errors.Is(err, os.ErrDeadlineExceeded))
+	err = mq.TimedSend([]byte(wired), 0, 2*time.Second)
+	assertTrue(t, errors.Is(err, os.ErrDeadlineExceeded))
+}
 
-	if _, _, err := mq.Receive(); err != nil {
-		t.Error(err)
+// closing the queue wakes up receives blocked on it
+func Test_CloseWakesReceive(t *testing.T) {
+	mq := SampleMessageQueue(t, 0, "clswake")
+
+	errs := make(chan error, 2)
+	go func() {
+		_, _, err := mq.Receive()
+		errs <- err
+	}()
+	go func() {
+		_, _, err := mq.ReceiveContext(context.Background())
+		errs <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	err := mq.Close()
+	assertNil(t, err)
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			assertEqual(t, syscall.EBADF, asErrno(err))
+		case <-time.After(time.Second):
+			t.Fatal("expected close to wake up the receive")
+		}
 	}
 
-	if count, _ := mq.Count(); count != 1 {
-		t.Errorf("expected count 1, got: %d", count)
-	}
+	err = posix_mq.ForceRemoveQueue("pmq_testing_clswake")
+	assertNil(t, err)
+}
 
-	if _, _, err := mq.Receive(); err != nil {
-		t.Error(err)
+// goroutines blocked on a queue are parked in the poller rather than holding an OS thread each
+func Test_BlockedReceiveParksGoroutine(t *testing.T) {
+	mq := SampleMessageQueue(t, 0, "parked")
+
+	const consumers = 100
+	threads := pprof.Lookup("threadcreate").Count()
+	errs := make(chan error, consumers)
+	for i := 0; i < consumers; i++ {
+		go func() {
+			_, _, err := mq.Receive()
+			errs <- err
+		}()
+	}
+	time.Sleep(200 * time.Millisecond)
+	if created := pprof.Lookup("threadcreate").Count() - threads; created >= consumers/2 {
+		t.Errorf("expected blocked receives to share threads, %d threads were created", created)
 	}
 
-	if count, _ := mq.Count(); count != 0 {
-		t.Errorf("expected count 0, got: %d", count)
+	for i := 0; i < consumers; i++ {
+		err := mq.Send([]byte(wired), 0)
+		assertNil(t, err)
+	}
+	for i := 0; i < consumers; i++ {
+		assertNil(t, <-errs)
 	}
 
 	err := mq.Unlink()
 	assertNil(t, err)
 }
 
-func Test_Notify(t *testing.T) {
-	mq := SampleMessageQueue(t, 0, "qnot")
-
-	mq.Notify(syscall.SIGUSR1)
-
-	sigc := make(chan os.Signal, 1)
-	signal.Notify(sigc, syscall.SIGUSR1)
-	signalsCaught := 0
-	go func(test *testing.T) {
-		for {
-			s := <-sigc
-			switch s {
-			case syscall.SIGUSR1:
-				test.Logf("catched signal: %-v", s)
+// many goroutines share a single queue, run with -race to check it is safe for concurrent use
+func Test_ConcurrentSendReceive(t *testing.T) {
+	posix_mq.ForceRemoveQueue("pmq_testing_concurrent")
+	config := posix_mq.QueueConfig{
+		Name:  "pmq_testing_concurrent",
+		Mode:  0660,
+		Flags: posix_mq.O_RDWR | posix_mq.O_CREAT,
+		Attrs: &posix_mq.MessageQueueAttribute{
+			MaxMsg:  10,
+			MsgSize: 64,
+		},
+	}
+	mq, err := posix_mq.NewMessageQueue(&config)
+	assertNil(t, err)
+	assertNotNil(t, mq)
+
+	const (
+		workers   = 16
+		perWorker = 200
+	)
+	receivers := []func() ([]byte, uint, error){
+		mq.Receive,
+		func() ([]byte, uint, error) {
+			return mq.TimedReceive(10 * time.Second)
+		},
+		func() ([]byte, uint, error) {
+			return mq.ReceiveContext(context.Background())
+		},
+	}
+	received := make(chan string, workers*perWorker)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				err := mq.Send([]byte(fmt.Sprintf("%s %d:%d", wired, w, i)), uint(i%4))
+				assertNil(t, err)
+			}
+		}()
+		go func(receive func() ([]byte, uint, error)) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				msg, _, err := receive()
+				assertNil(t, err)
+				received <- string(msg)
+			}
+		}(receivers[w%len(receivers)])
+	}
+	wg.Wait()
+	close(received)
 
-				response, _, err := mq.Receive()
+	seen := make(map[string]bool)
+	for msg := range received {
+		if seen[msg] {
+			t.Errorf("received %s more than once", msg)
+		}
+		seen[msg] = true
+	}
+	assertEqual(t, workers*perWorker, len(seen))
 
-				if err != nil {
-					test.Error(err)
-				}
+	err = mq.Unlink()
+	assertNil(t, err)
+}
 
-				if wired != string(response) {
+func Test_ReceiveInto(t *testing.T) {
+	posix_mq.ForceRemoveQueue("pmq_testing_rcvinto")
+	config := posix_mq.QueueConfig{
+		Name:  "pmq_testing_rcvinto",
+		Mode:  0660,
+		Flags: posix_mq.O_RDWR | posix_mq.O_CREAT,
+		Attrs: &posix_mq.MessageQueueAttribute{
+			MaxMsg:  10,
+			MsgSize: 64,
+		},
+	}
+	mq, err := posix_mq.NewMessageQueue(&config)
+	assertNil(t, err)
+	assertNotNil(t, mq)
+
+	err = mq.Send([]byte(wired), 3)
+	assertNil(t, err)
+	buf := make([]byte, 64)
+	n, prio, err := mq.ReceiveInto(buf)
+	assertNil(t, err)
+	assertEqual(t, wired, string(buf[:n]))
+	assertEqual(t, uint(3), prio)
+
+	//a buffer smaller than the message size of the queue is refused, leaving the message on the queue
+	err = mq.Send([]byte(wired), 0)
+	assertNil(t, err)
+	n, _, err = mq.ReceiveInto(buf[:63])
+	assertEqual(t, 0, n)
+	assertEqual(t, syscall.EMSGSIZE, asErrno(err))
+	count, err := mq.Count()
+	assertNil(t, err)
+	assertEqual(t, 1, count)
+
+	err = mq.Unlink()
+	assertNil(t, err)
+}
+
+// without attributes the queue is created with the system defaults, which size the receive buffer
+func Test_MaxMessageSize(t *testing.T) {
+	posix_mq.ForceRemoveQueue("pmq_testing_maxmsgsize")
+	mq := SampleMessageQueue(t, 0, "maxmsgsize")
+
+	attr, err := mq.GetAttr()
+	assertNil(t, err)
+	assertEqual(t, attr.MsgSize, mq.MaxMessageSize())
+	err = mq.Send(make([]byte, mq.MaxMessageSize()), 0)
+	assertNil(t, err)
+	err = mq.Send(make([]byte, mq.MaxMessageSize()+1), 0)
+	assertEqual(t, syscall.EMSGSIZE, asErrno(err))
+	msg, _, err := mq.Receive()
+	assertNil(t, err)
+	assertEqual(t, mq.MaxMessageSize(), len(msg))
+
+	err = mq.Unlink()
+	assertNil(t, err)
+}
+
+type sample struct {
+	ID    uint32
+	Value float64
+	Tag   [4]byte
+}
+
+func Test_TypedQueue(t *testing.T) {
+	codecs := map[string]posix_mq.Codec[sample]{
+		"json":   posix_mq.JSONCodec[sample]{},
+		"gob":    posix_mq.GobCodec[sample]{},
+		"binary": posix_mq.BinaryCodec[sample]{},
+	}
+	for name, codec := range codecs {
+		t.Run(name, func(t *testing.T) {
+			q := posix_mq.NewTypedQueue(SampleMessageQueue(t, 0, "typed_"+name), codec)
+			defer q.Queue().Unlink()
+
+			want := sample{ID: 7, Value: 1.5, Tag: [4]byte{'a', 'b', 'c', 'd'}}
+			assertNil(t, q.Send(want, 2))
+			got, prio, err := q.Receive()
+			assertNil(t, err)
+			assertEqual(t, want, got)
+			assertEqual(t, uint(2), prio)
+
+			//a message that is not a sample is consumed and reported as a decode error
+			assertNil(t, q.Queue().Send([]byte{0xff}, 1))
+			_, _, err = q.Receive()
+			var decodeErr *posix_mq.DecodeError
+			assertTrue(t, errors.As(err, &decodeErr))
+			assertTrue(t, bytes.Equal([]byte{0xff}, decodeErr.Data))
+			assertEqual(t, uint(1), decodeErr.Priority)
+			count, err := q.Queue().Count()
+			assertNil(t, err)
+			assertEqual(t, 0, count)
+
+			//errors of the queue are not decode errors
+			_, _, err = q.TimedReceive(10 * time.Millisecond)
+			assertTrue(t, errors.Is(err, posix_mq.ErrTimeout))
+			assertTrue(t, !errors.As(err, &decodeErr))
+		})
+	}
+}
+
+func Test_TypedQueueMessageTooLarge(t *testing.T) {
+	posix_mq.ForceRemoveQueue("pmq_testing_typed_large")
+	mq, err := posix_mq.NewMessageQueue(&posix_mq.QueueConfig{
+		Name:  "pmq_testing_typed_large",
+		Mode:  0660,
+		Flags: posix_mq.O_RDWR | posix_mq.O_CREAT | posix_mq.O_NONBLOCK,
+		Attrs: &posix_mq.MessageQueueAttribute{MaxMsg: 1, MsgSize: 8},
+	})
+	assertNil(t, err)
+	defer mq.Unlink()
+
+	q := posix_mq.NewTypedQueue[string](mq, posix_mq.JSONCodec[string]{})
+	err = q.Send("longer than eight bytes", 0)
+	assertTrue(t, errors.Is(err, posix_mq.ErrMessageTooLarge))
+	var opErr *posix_mq.OpError
+	assertTrue(t, errors.As(err, &opErr))
+	assertEqual(t, "encode", opErr.Op)
+
+	_, err = posix_mq.BinaryCodec[string]{}.Encode("not fixed-size")
+	assertNotNil(t, err)
+}
+
+func Test_MessageEnvelope(t *testing.T) {
+	mq := SampleMessageQueue(t, 0, "envelope")
+	defer mq.Unlink()
+
+	sent := &posix_mq.Message{
+		ContentType: "text/plain",
+		TraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		Headers:     map[string]string{"tenant": "narwhal"},
+		Priority:    4,
+		Data:        []byte(wired),
+	}
+	assertNil(t, mq.SendMessage(sent))
+	assertTrue(t, sent.ID != "")
+	assertEqual(t, os.Getpid(), sent.SenderPID)
+
+	got, err := mq.ReceiveMessage()
+	assertNil(t, err)
+	assertTrue(t, !got.Legacy)
+	assertEqual(t, sent.ID, got.ID)
+	assertTrue(t, sent.Time.Equal(got.Time))
+	assertEqual(t, sent.SenderPID, got.SenderPID)
+	assertEqual(t, sent.ContentType, got.ContentType)
+	assertEqual(t, sent.TraceParent, got.TraceParent)
+	assertTrue(t, reflect.DeepEqual(sent.Headers, got.Headers))
+	assertEqual(t, uint(4), got.Priority)
+	assertEqual(t, wired, string(got.Data))
+
+	//messages of producers not using envelopes are still received
+	assertNil(t, mq.Send([]byte(wired), 1))
+	got, err = mq.ReceiveMessage()
+	assertNil(t, err)
+	assertTrue(t, got.Legacy)
+	assertEqual(t, uint(1), got.Priority)
+	assertEqual(t, wired, string(got.Data))
+
+	//a damaged envelope is a decode error
+	data, err := sent.MarshalBinary()
+	assertNil(t, err)
+	assertNil(t, mq.Send(data[:len(posix_mq.EnvelopeMagic)+3], 0))
+	_, err = mq.ReceiveMessage()
+	var decodeErr *posix_mq.DecodeError
+	assertTrue(t, errors.As(err, &decodeErr))
+
+	data[len(posix_mq.EnvelopeMagic)] = posix_mq.EnvelopeVersion + 1
+	var m posix_mq.Message
+	assertNotNil(t, m.UnmarshalBinary(data))
+}
+
+func chunkedQueue(t *testing.T, postfix string, flags int, config *posix_mq.ChunkConfig) *posix_mq.ChunkedQueue {
+	posix_mq.ForceRemoveQueue("pmq_testing_" + postfix)
+	mq, err := posix_mq.NewMessageQueue(&posix_mq.QueueConfig{
+		Name:  "pmq_testing_" + postfix,
+		Mode:  0660,
+		Flags: posix_mq.O_RDWR | posix_mq.O_CREAT | flags,
+		Attrs: &posix_mq.MessageQueueAttribute{MaxMsg: 10, MsgSize: 128},
+	})
+	assertNil(t, err)
+	t.Cleanup(func() { mq.Unlink() })
+	return posix_mq.NewChunkedQueue(mq, config)
+}
+
+func Test_ChunkedQueue(t *testing.T) {
+	cq := chunkedQueue(t, "chunked", 0, nil)
+
+	//two producers interleave their fragments, while small messages fit in one
+	payloads := [][]byte{
+		bytes.Repeat([]byte("narwhal "), 1000),
+		bytes.Repeat([]byte("ice cream "), 700),
+		[]byte(wired),
+		{},
+	}
+	var wg sync.WaitGroup
+	for _, payload := range payloads {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assertNil(t, cq.Send(payload, 1))
+		}()
+	}
+
+	received := map[string]bool{}
+	for range payloads {
+		data, prio, err := cq.Receive()
+		assertNil(t, err)
+		assertEqual(t, uint(1), prio)
+		received[string(data)] = true
+	}
+	wg.Wait()
+	for _, payload := range payloads {
+		assertTrue(t, received[string(payload)])
+	}
+	assertEqual(t, uint64(0), cq.Dropped())
+
+	//messages sent without chunking are passed through
+	assertNil(t, cq.Queue().Send([]byte(wired), 0))
+	data, _, err := cq.Receive()
+	assertNil(t, err)
+	assertEqual(t, wired, string(data))
+}
+
+func Test_ChunkedQueueDropsIncomplete(t *testing.T) {
+	cq := chunkedQueue(t, "chunked_drop", posix_mq.O_NONBLOCK, &posix_mq.ChunkConfig{
+		Timeout: 50 * time.Millisecond,
+	})
+
+	//the queue holds 10 fragments of 91 bytes, the rest of the payload does not make it
+	err := cq.Send(make([]byte, 1000), 0)
+	assertTrue(t, errors.Is(err, posix_mq.ErrQueueFull))
+	_, _, err = cq.Receive()
+	assertTrue(t, errors.Is(err, posix_mq.ErrQueueEmpty))
+
+	time.Sleep(100 * time.Millisecond)
+	assertNil(t, cq.Send(make([]byte, 200), 0))
+	data, _, err := cq.Receive()
+	assertNil(t, err)
+	assertEqual(t, 200, len(data))
+	assertEqual(t, uint64(1), cq.Dropped())
+
+	//payloads beyond MaxPending are never held
+	small := posix_mq.NewChunkedQueue(cq.Queue(), &posix_mq.ChunkConfig{MaxPending: 500})
+	assertNil(t, cq.Send(make([]byte, 600), 0))
+	_, _, err = small.Receive()
+	assertTrue(t, errors.Is(err, posix_mq.ErrQueueEmpty))
+	assertEqual(t, uint64(1), small.Dropped())
+}
+
+// a fragment of the wrong length, e.g. a truncated last one, drops its payload instead of completing it
+func Test_ChunkedQueueRejectsTruncated(t *testing.T) {
+	cq := chunkedQueue(t, "chunked_trunc", posix_mq.O_NONBLOCK, nil)
+	chunkSize := cq.Queue().MaxMessageSize() - 37 //less the fragment header
+	fragment := func(id byte, index, count int, size int, chunk []byte) []byte {
+		header := append(append([]byte{}, posix_mq.ChunkMagic[:]...), posix_mq.ChunkVersion)
+		header = append(header, bytes.Repeat([]byte{id}, 16)...)
+		header = binary.BigEndian.AppendUint32(header, uint32(index))
+		header = binary.BigEndian.AppendUint32(header, uint32(count))
+		header = binary.BigEndian.AppendUint64(header, uint64(size))
+		return append(header, chunk...)
+	}
+
+	size := chunkSize + 50
+	assertNil(t, cq.Queue().Send(fragment(1, 0, 2, size, make([]byte, chunkSize)), 0))
+	assertNil(t, cq.Queue().Send(fragment(1, 1, 2, size, make([]byte, 10)), 0))
+	//the complete last fragment arriving afterwards is ignored as well
+	assertNil(t, cq.Queue().Send(fragment(1, 1, 2, size, make([]byte, 50)), 0))
+	_, _, err := cq.Receive()
+	assertTrue(t, errors.Is(err, posix_mq.ErrQueueEmpty))
+	assertEqual(t, uint64(1), cq.Dropped())
+
+	//as is a payload whose fragments are short of a chunk
+	assertNil(t, cq.Queue().Send(fragment(2, 0, 2, size, make([]byte, chunkSize-1)), 0))
+	_, _, err = cq.Receive()
+	assertTrue(t, errors.Is(err, posix_mq.ErrQueueEmpty))
+	assertEqual(t, uint64(2), cq.Dropped())
+
+	//well-formed fragments still make a payload
+	payload := bytes.Repeat([]byte{7}, size)
+	assertNil(t, cq.Queue().Send(fragment(3, 1, 2, size, payload[chunkSize:]), 0))
+	assertNil(t, cq.Queue().Send(fragment(3, 0, 2, size, payload[:chunkSize]), 0))
+	data, _, err := cq.Receive()
+	assertNil(t, err)
+	assertTrue(t, bytes.Equal(payload, data))
+}
+
+func Test_ShmQueue(t *testing.T) {
+	mq := SampleMessageQueue(t, 0, "shm")
+	defer mq.Unlink()
+	dir := t.TempDir()
+	sq := posix_mq.NewShmQueue(mq, &posix_mq.ShmConfig{Threshold: 64, Dir: dir})
+
+	//small payloads are sent as they are
+	assertNil(t, sq.Send([]byte(wired), 0))
+	data, _, err := sq.Receive()
+	assertNil(t, err)
+	assertEqual(t, wired, string(data))
+
+	payload := bytes.Repeat([]byte(wired), 1<<16)
+	assertNil(t, sq.Send(payload, 3))
+	segments, err := os.ReadDir(dir)
+	assertNil(t, err)
+	assertEqual(t, 1, len(segments))
+	data, prio, err := sq.Receive()
+	assertNil(t, err)
+	assertEqual(t, uint(3), prio)
+	assertTrue(t, bytes.Equal(payload, data))
+	segments, err = os.ReadDir(dir)
+	assertNil(t, err)
+	assertEqual(t, 0, len(segments))
+
+	//a damaged segment is a decode error
+	assertNil(t, sq.Send(payload, 0))
+	segments, err = os.ReadDir(dir)
+	assertNil(t, err)
+	assertNil(t, os.WriteFile(dir+"/"+segments[0].Name(), make([]byte, len(payload)), 0600))
+	_, _, err = sq.Receive()
+	var decodeErr *posix_mq.DecodeError
+	assertTrue(t, errors.As(err, &decodeErr))
+}
+
+func Test_SweepSegments(t *testing.T) {
+	mq := SampleMessageQueue(t, 0, "shm_sweep")
+	dir := t.TempDir()
+	sq := posix_mq.NewShmQueue(mq, &posix_mq.ShmConfig{Threshold: 1, Dir: dir})
+	assertNil(t, sq.Send([]byte(wired), 0))
+
+	//the segment of a message still queued is kept until it is old enough
+	removed, err := posix_mq.SweepSegments(dir, time.Hour)
+	assertNil(t, err)
+	assertEqual(t, 0, removed)
+	removed, err = posix_mq.SweepSegments(dir, 0)
+	assertNil(t, err)
+	assertEqual(t, 1, removed)
+	_, _, err = sq.Receive()
+	assertTrue(t, errors.Is(err, posix_mq.ErrNotFound))
+
+	//segments of queues that are gone are removed right away
+	assertNil(t, sq.Send([]byte(wired), 0))
+	assertNil(t, mq.Unlink())
+	removed, err = posix_mq.SweepSegments(dir, time.Hour)
+	assertNil(t, err)
+	assertEqual(t, 1, removed)
+}
+
+func Test_Messages(t *testing.T) {
+	mq := SampleMessageQueue(t, 0, "messages")
+	defer mq.Unlink()
+
+	go func() {
+		for i := 0; i < 3; i++ {
+			mq.SendMessage(&posix_mq.Message{Data: []byte(strconv.Itoa(i))})
+		}
+		mq.Send([]byte(wired), 0)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var received []string
+	for msg, err := range mq.Messages(ctx) {
+		assertNil(t, err)
+		received = append(received, string(msg.Data))
+		if msg.Legacy {
+			//stops the sequence once the queue is empty again
+			cancel()
+		}
+	}
+	assertTrue(t, slices.Equal([]string{"0", "1", "2", wired}, received))
+}
+
+func Test_Drain(t *testing.T) {
+	//draining does not wait even on a blocking queue
+	mq := SampleMessageQueue(t, 0, "drain")
+	defer mq.Unlink()
+
+	for msg, err := range mq.Drain() {
+		t.Errorf("expected an empty queue, got: %v, %v", msg, err)
+	}
+
+	for i := 0; i < 5; i++ {
+		assertNil(t, mq.Send([]byte(strconv.Itoa(i)), 0))
+	}
+	var drained int
+	for msg, err := range mq.Drain() {
+		assertNil(t, err)
+		assertTrue(t, msg.Legacy)
+		//only the messages queued when draining started are drained
+		assertNil(t, mq.Send([]byte(wired), 0))
+		drained++
+	}
+	assertEqual(t, 5, drained)
+
+	for range mq.Drain() {
+		break
+	}
+	count, err := mq.Count()
+	assertNil(t, err)
+	assertEqual(t, 4, count)
+}
+
+func Test_Purge(t *testing.T) {
+	mq := SampleMessageQueue(t, 0, "purge")
+	defer mq.Unlink()
+	//another process keeps the queue open throughout
+	other := SampleMessageQueue(t, posix_mq.O_WRONLY, "purge")
+	defer other.Close()
+
+	for i := 0; i < 3; i++ {
+		assertNil(t, other.Send([]byte(wired), 0))
+	}
+	purged, err := mq.Purge()
+	assertNil(t, err)
+	assertEqual(t, 3, purged)
+	count, err := mq.Count()
+	assertNil(t, err)
+	assertEqual(t, 0, count)
+
+	purged, err = mq.Purge()
+	assertNil(t, err)
+	assertEqual(t, 0, purged)
+	assertNil(t, other.Send([]byte(wired), 0))
+}
+
+func Test_DrainTo(t *testing.T) {
+	mq := SampleMessageQueue(t, 0, "drainto")
+	defer mq.Unlink()
+	dlq := SampleMessageQueue(t, 0, "drainto_dlq")
+	defer dlq.Unlink()
+
+	for i := 0; i < 4; i++ {
+		assertNil(t, mq.Send([]byte(strconv.Itoa(i)), uint(i)))
+	}
+	var priorities []uint
+	drained, err := mq.DrainTo(posix_mq.SinkFunc(func(data []byte, priority uint) error {
+		priorities = append(priorities, priority)
+		if priority == 1 {
+			return errors.New("sink is full")
+		}
+		return dlq.Send(data, priority)
+	}))
+	assertNotNil(t, err)
+	assertEqual(t, 3, drained)
+	assertTrue(t, slices.Equal([]uint{3, 2, 1}, priorities))
+
+	count, err := dlq.Count()
+	assertNil(t, err)
+	assertEqual(t, 2, count)
+	drained, err = mq.DrainTo(posix_mq.SinkFunc(dlq.Send))
+	assertNil(t, err)
+	assertEqual(t, 1, drained)
+	msg, prio, err := dlq.Receive()
+	assertNil(t, err)
+	assertEqual(t, "3", string(msg))
+	assertEqual(t, uint(3), prio)
+}
+
+func Test_Consumer(t *testing.T) {
+	posix_mq.ForceRemoveQueue("pmq_testing_consumer")
+	mq := SampleMessageQueue(t, 0, "consumer")
+	defer mq.Unlink()
+
+	var (
+		handled             sync.WaitGroup
+		mu                  sync.Mutex
+		running, maxRunning int
+		failed              []string
+		panicked            *posix_mq.PanicError
+	)
+	consumer := posix_mq.NewConsumer(mq, func(ctx context.Context, msg []byte, prio uint) error {
+		defer handled.Done()
+		mu.Lock()
+		running++
+		maxRunning = max(maxRunning, running)
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		switch string(msg) {
+		case "panic":
+			panic("handler panic")
+		case "fail":
+			return errors.New("handler failed")
+		}
+		return nil
+	}, 3)
+	consumer.OnError = func(err error, msg []byte, prio uint) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !errors.As(err, &panicked) {
+			failed = append(failed, string(msg))
+		}
+	}
+
+	messages := []string{"panic", "fail"}
+	for i := 0; i < 8; i++ {
+		messages = append(messages, strconv.Itoa(i))
+	}
+	handled.Add(len(messages))
+	for _, msg := range messages {
+		assertNil(t, mq.Send([]byte(msg), 0))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() {
+		result <- consumer.Run(ctx)
+	}()
+	handled.Wait()
+	cancel()
+	assertEqual(t, context.Canceled, <-result)
+
+	assertEqual(t, 3, maxRunning)
+	assertTrue(t, slices.Equal([]string{"fail"}, failed))
+	assertNotNil(t, panicked)
+	assertEqual(t, any("handler panic"), panicked.Value)
+}
+
+// shutting down stops receiving and waits for the messages in flight, cancelling them once out of time
+func Test_ConsumerShutdown(t *testing.T) {
+	posix_mq.ForceRemoveQueue("pmq_testing_consumersd")
+	mq := SampleMessageQueue(t, 0, "consumersd")
+	defer mq.Unlink()
+
+	started := make(chan struct{}, 2)
+	consumer := posix_mq.NewConsumer(mq, func(ctx context.Context, msg []byte, prio uint) error {
+		started <- struct{}{}
+		<-ctx.Done()
+		return ctx.Err()
+	}, 1)
+	var reported atomic.Value
+	consumer.OnError = func(err error, msg []byte, prio uint) {
+		reported.Store(err)
+	}
+	assertNil(t, mq.Send([]byte("1"), 0))
+	assertNil(t, mq.Send([]byte("2"), 0))
+	result := make(chan error)
+	go func() {
+		result <- consumer.Run(context.Background())
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assertEqual(t, context.DeadlineExceeded, consumer.Shutdown(ctx))
+	assertNil(t, <-result)
+	assertEqual(t, any(context.Canceled), reported.Load())
+	//the second message was never received
+	count, err := mq.Count()
+	assertNil(t, err)
+	assertEqual(t, 1, count)
+}
+
+func Test_RetryBackoff(t *testing.T) {
+	policy := &posix_mq.RetryPolicy{MaxBackoff: 300 * time.Millisecond, Jitter: -1}
+	assertEqual(t, 100*time.Millisecond, policy.Backoff(1))
+	assertEqual(t, 200*time.Millisecond, policy.Backoff(2))
+	assertEqual(t, 300*time.Millisecond, policy.Backoff(3))
+
+	policy.Jitter = 0.5
+	for attempt := 1; attempt <= 3; attempt++ {
+		backoff := policy.Backoff(attempt)
+		assertTrue(t, backoff >= 50*time.Millisecond && backoff <= 300*time.Millisecond)
+	}
+}
+
+// a failing message is retried, then sent to the dead-letter queue, from which it is redriven
+func Test_ConsumerDeadLetter(t *testing.T) {
+	posix_mq.ForceRemoveQueue("pmq_testing_consumerdl")
+	posix_mq.ForceRemoveQueue("pmq_testing_consumerdl_dlq")
+	mq := SampleMessageQueue(t, 0, "consumerdl")
+	defer mq.Unlink()
+	dlq := SampleMessageQueue(t, 0, "consumerdl_dlq")
+	defer dlq.Unlink()
+
+	var (
+		mu       sync.Mutex
+		attempts = make(map[string]int)
+		failed   []string
+		handled  sync.WaitGroup
+	)
+	consumer := posix_mq.NewConsumer(mq, func(ctx context.Context, msg []byte, prio uint) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[string(msg)]++
+		if string(msg) == "poison" || attempts[string(msg)] < 2 {
+			return fmt.Errorf("attempt %d failed", attempts[string(msg)])
+		}
+		handled.Done()
+		return nil
+	}, 2)
+	consumer.Retry = &posix_mq.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+	consumer.DeadLetter = dlq
+	consumer.OnError = func(err error, msg []byte, prio uint) {
+		mu.Lock()
+		defer mu.Unlock()
+		failed = append(failed, err.Error())
+		handled.Done()
+	}
+
+	handled.Add(2)
+	assertNil(t, mq.Send([]byte("poison"), 4))
+	assertNil(t, mq.Send([]byte("flaky"), 1))
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() {
+		result <- consumer.Run(ctx)
+	}()
+	handled.Wait()
+	cancel()
+	<-result
+	assertEqual(t, 3, attempts["poison"])
+	assertEqual(t, 2, attempts["flaky"])
+	assertTrue(t, slices.Equal([]string{"attempt 3 failed"}, failed))
+
+	m, err := dlq.ReceiveMessage()
+	assertNil(t, err)
+	assertEqual(t, "poison", string(m.Data))
+	assertEqual(t, uint(4), m.Priority)
+	assertTrue(t, reflect.DeepEqual(map[string]string{
+		posix_mq.HeaderDeadLetterSource:   "pmq_testing_consumerdl",
+		posix_mq.HeaderDeadLetterPriority: "4",
+		posix_mq.HeaderDeadLetterAttempts: "3",
+		posix_mq.HeaderDeadLetterError:    "attempt 3 failed",
+	}, m.Headers))
+
+	//redriving puts the dead letters back, leaving other messages in the dead-letter queue
+	data, err := m.MarshalBinary()
+	assertNil(t, err)
+	assertNil(t, dlq.Send(data, 4))
+	assertNil(t, dlq.Send([]byte("not a dead letter"), 7))
+	moved, err := dlq.Redrive()
+	assertNil(t, err)
+	assertEqual(t, 1, moved)
+	msg, prio, err := mq.Receive()
+	assertNil(t, err)
+	assertEqual(t, "poison", string(msg))
+	assertEqual(t, uint(4), prio)
+	msg, _, err = dlq.Receive()
+	assertNil(t, err)
+	assertEqual(t, "not a dead letter", string(msg))
+}
+
+// a full dead-letter queue holds up the handler until there is room, and a dead letter that cannot fit is reported
+func Test_ConsumerDeadLetterFull(t *testing.T) {
+	posix_mq.ForceRemoveQueue("pmq_testing_consumerdlfull")
+	posix_mq.ForceRemoveQueue("pmq_testing_consumerdlfull_dlq")
+	mq := SampleMessageQueue(t, 0, "consumerdlfull")
+	defer mq.Unlink()
+	dlq, err := posix_mq.NewMessageQueue(&posix_mq.QueueConfig{
+		Name:  "pmq_testing_consumerdlfull_dlq",
+		Mode:  0660,
+		Flags: posix_mq.O_RDWR | posix_mq.O_CREAT,
+		Attrs: &posix_mq.MessageQueueAttribute{MaxMsg: 1, MsgSize: 1024},
+	})
+	assertNil(t, err)
+	defer dlq.Unlink()
+	assertNil(t, dlq.Send([]byte("filler"), 0))
+
+	failed := make(chan error, 2)
+	consumer := posix_mq.NewConsumer(mq, func(ctx context.Context, msg []byte, prio uint) error {
+		return errors.New(strings.Repeat("x", 4096))
+	}, 1)
+	consumer.DeadLetter = dlq
+	consumer.OnError = func(err error, msg []byte, prio uint) {
+		failed <- err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go consumer.Run(ctx)
+
+	assertNil(t, mq.Send([]byte("poison"), 0))
+	select {
+	case err := <-failed:
+		t.Fatalf("expected the dead letter to wait for room, got: %s", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	msg, _, err := dlq.Receive()
+	assertNil(t, err)
+	assertEqual(t, "filler", string(msg))
+	recvCtx, recvCancel := context.WithTimeout(context.Background(), time.Second)
+	defer recvCancel()
+	m, err := dlq.ReceiveMessageContext(recvCtx)
+	assertNil(t, err)
+	assertEqual(t, "poison", string(m.Data))
+	assertTrue(t, len(m.Headers[posix_mq.HeaderDeadLetterError]) < 1024)
+	assertTrue(t, strings.HasSuffix(m.Headers[posix_mq.HeaderDeadLetterError], "..."))
+	<-failed
+
+	//a dead letter larger than the messages of the queue is not sent
+	assertNil(t, mq.Send(bytes.Repeat([]byte("p"), 1024), 0))
+	err = <-failed
+	assertTrue(t, errors.Is(err, posix_mq.ErrMessageTooLarge))
+	_, _, err = dlq.TimedReceive(10 * time.Millisecond)
+	assertEqual(t, syscall.ETIMEDOUT, asErrno(err))
+}
+
+// expired messages are discarded by the receive calls, the others received without their deadline
+func Test_SendWithTTL(t *testing.T) {
+	posix_mq.ForceRemoveQueue("pmq_testing_ttl")
+	mq, err := posix_mq.NewMessageQueue(&posix_mq.QueueConfig{
+		Name:  "pmq_testing_ttl",
+		Mode:  0660,
+		Flags: posix_mq.O_RDWR | posix_mq.O_CREAT,
+		TTL:   true,
+	})
+	assertNil(t, err)
+	defer mq.Unlink()
+	var expired []string
+	mq.SetExpiredSink(posix_mq.SinkFunc(func(data []byte, priority uint) error {
+		expired = append(expired, fmt.Sprintf("%s/%d", data, priority))
+		return nil
+	}))
+
+	err = mq.SendWithTTL([]byte("never"), 0, 0)
+	assertEqual(t, syscall.EINVAL, asErrno(err))
+	assertNil(t, mq.SendWithTTL([]byte("stale"), 5, 10*time.Millisecond))
+	assertNil(t, mq.SendWithTTL([]byte("fresh"), 1, time.Minute))
+	assertNil(t, mq.Send([]byte("plain"), 0))
+	time.Sleep(20 * time.Millisecond)
+
+	msg, prio, err := mq.Receive()
+	assertNil(t, err)
+	assertEqual(t, "fresh", string(msg))
+	assertEqual(t, uint(1), prio)
+	buf := make([]byte, mq.MaxMessageSize())
+	size, _, err := mq.ReceiveInto(buf)
+	assertNil(t, err)
+	assertEqual(t, "plain", string(buf[:size]))
+	assertEqual(t, uint64(1), mq.Expired())
+	assertTrue(t, slices.Equal([]string{"stale/5"}, expired))
+
+	//a timed receive keeps waiting past the expired messages
+	mq.SetExpiredSink(nil)
+	assertNil(t, mq.SendWithTTL([]byte("stale"), 0, time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+	_, _, err = mq.TimedReceive(50 * time.Millisecond)
+	assertTrue(t, errors.Is(err, posix_mq.ErrTimeout))
+	assertEqual(t, uint64(2), mq.Expired())
+	assertEqual(t, 1, len(expired))
+
+	//draining counts the expired messages it discards, without handing them to the sink
+	assertNil(t, mq.SendWithTTL([]byte("stale"), 2, time.Millisecond))
+	assertNil(t, mq.SendWithTTL([]byte("fresh"), 1, time.Minute))
+	assertNil(t, mq.Send([]byte("plain"), 0))
+	time.Sleep(5 * time.Millisecond)
+	var drained []string
+	n, err := mq.DrainTo(posix_mq.SinkFunc(func(data []byte, priority uint) error {
+		drained = append(drained, string(data))
+		return nil
+	}))
+	assertNil(t, err)
+	assertEqual(t, 3, n)
+	assertTrue(t, slices.Equal([]string{"fresh", "plain"}, drained))
+	assertEqual(t, uint64(3), mq.Expired())
+
+	assertNil(t, mq.SendWithTTL([]byte("stale"), 0, time.Millisecond))
+	assertNil(t, mq.Send([]byte("plain"), 0))
+	time.Sleep(5 * time.Millisecond)
+	n, err = mq.Purge()
+	assertNil(t, err)
+	assertEqual(t, 2, n)
+	assertEqual(t, uint64(4), mq.Expired())
+}
+
+// without QueueConfig.TTL messages are received as sent, even when they look like they carry a deadline
+func Test_TTLOptIn(t *testing.T) {
+	raw := append(append([]byte{}, posix_mq.TTLMagic[:]...), posix_mq.TTLVersion, 0, 0, 0, 0, 0, 0, 0, 1)
+	raw = append(raw, "payload"...)
+	forEachQueueImpl(t, func(t *testing.T, impl queueImpl) {
+		mq := sampleQueue(t, impl, 0, "ttloptin")
+		defer mq.Unlink()
+
+		assertNil(t, mq.Send(raw, 0))
+		msg, _, err := mq.Receive()
+		assertNil(t, err)
+		assertTrue(t, bytes.Equal(raw, msg))
+	})
+
+	posix_mq.ForceRemoveQueue("pmq_testing_ttloptin")
+	mq := SampleMessageQueue(t, 0, "ttloptin")
+	defer mq.Unlink()
+	assertNil(t, mq.Send(raw, 0))
+	buf := make([]byte, mq.MaxMessageSize())
+	size, _, err := mq.ReceiveInto(buf)
+	assertNil(t, err)
+	assertTrue(t, bytes.Equal(raw, buf[:size]))
+	assertNil(t, mq.SendWithTTL([]byte("fresh"), 0, time.Minute))
+	msg, _, err := mq.Receive()
+	assertNil(t, err)
+	assertEqual(t, 13+len("fresh"), len(msg))
+	assertNil(t, mq.Send(raw, 0))
+	purged, err := mq.Purge()
+	assertNil(t, err)
+	assertEqual(t, 1, purged)
+	assertEqual(t, uint64(0), mq.Expired())
+}
+
+func Test_MemoryQueueTTL(t *testing.T) {
+	mq, err := posix_mq.NewMemoryQueue(&posix_mq.QueueConfig{Name: "pmq_testing_memttl", Flags: posix_mq.O_RDWR | posix_mq.O_CREAT, TTL: true})
+	assertNil(t, err)
+	defer mq.Unlink()
+	var expired []string
+	mq.SetExpiredSink(posix_mq.SinkFunc(func(data []byte, priority uint) error {
+		expired = append(expired, fmt.Sprintf("%s/%d", data, priority))
+		return nil
+	}))
+
+	err = mq.SendWithTTL([]byte("never"), 0, 0)
+	assertEqual(t, syscall.EINVAL, asErrno(err))
+	assertNil(t, mq.SendWithTTL([]byte("stale"), 5, time.Millisecond))
+	assertNil(t, mq.SendWithTTL([]byte("fresh"), 1, time.Minute))
+	time.Sleep(5 * time.Millisecond)
+
+	msg, prio, err := mq.Receive()
+	assertNil(t, err)
+	assertEqual(t, "fresh", string(msg))
+	assertEqual(t, uint(1), prio)
+	assertEqual(t, uint64(1), mq.Expired())
+	assertTrue(t, slices.Equal([]string{"stale/5"}, expired))
+	_, _, err = mq.TimedReceive(10 * time.Millisecond)
+	assertTrue(t, errors.Is(err, posix_mq.ErrTimeout))
+}
+
+func Test_QueuePriority(t *testing.T) {
+	forEachQueueImpl(t, func(t *testing.T, impl queueImpl) {
+		mq := sampleQueue(t, impl, 0, "qprio")
+
+		err := mq.Send([]byte(wired), 3)
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		_, mtype, err := mq.Receive()
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		if mtype != 3 {
+			t.Errorf("expected mtype 3, got: %d", mtype)
+		}
+
+		err = mq.Unlink()
+		assertNil(t, err)
+	})
+}
+
+// messages are received by priority, oldest first within a priority
+func Test_QueueOrder(t *testing.T) {
+	forEachQueueImpl(t, func(t *testing.T, impl queueImpl) {
+		impl.remove("pmq_testing_qorder")
+		mq := sampleQueue(t, impl, 0, "qorder")
+		for i, prio := range []uint{1, 3, 1, 2} {
+			assertNil(t, mq.Send([]byte(strconv.Itoa(i)), prio))
+		}
+		for _, want := range []string{"1", "3", "0", "2"} {
+			msg, _, err := mq.Receive()
+			assertNil(t, err)
+			assertEqual(t, want, string(msg))
+		}
+		assertNil(t, mq.Unlink())
+	})
+}
+
+// a blocked receive is woken up by a send on another handle, and by Close
+func Test_QueueBlocking(t *testing.T) {
+	forEachQueueImpl(t, func(t *testing.T, impl queueImpl) {
+		impl.remove("pmq_testing_qblk")
+		receiver := sampleQueue(t, impl, posix_mq.O_RDONLY|posix_mq.O_CREAT, "qblk")
+		sender := sampleQueue(t, impl, posix_mq.O_WRONLY, "qblk")
+		defer sender.Close()
+
+		time.AfterFunc(50*time.Millisecond, func() {
+			sender.Send([]byte(wired), 0)
+		})
+		msg, _, err := receiver.Receive()
+		assertNil(t, err)
+		assertEqual(t, wired, string(msg))
+
+		time.AfterFunc(50*time.Millisecond, func() {
+			receiver.Close()
+		})
+		_, _, err = receiver.Receive()
+		assertTrue(t, errors.Is(err, posix_mq.ErrClosed))
+		assertNil(t, impl.remove("pmq_testing_qblk"))
+	})
+}
+
+func Test_QueueCount(t *testing.T) {
+	mq := SampleMessageQueue(t, 0, "qcnt")
+
+	if err := mq.Send([]byte(wired), 0); err != nil {
+		t.Error(err)
+	}
+
+	if err := mq.Send([]byte(wired), 0); err != nil {
+		t.Error(err)
+	}
+
+	if count, _ := mq.Count(); count != 2 {
+		t.Errorf("expected count 2, got: %d", count)
+	}
+
+	if _, _, err := mq.Receive(); err != nil {
+		t.Error(err)
+	}
+
+	if count, _ := mq.Count(); count != 1 {
+		t.Errorf("expected count 1, got: %d", count)
+	}
+
+	if _, _, err := mq.Receive(); err != nil {
+		t.Error(err)
+	}
+
+	if count, _ := mq.Count(); count != 0 {
+		t.Errorf("expected count 0, got: %d", count)
+	}
+
+	err := mq.Unlink()
+	assertNil(t, err)
+}
+
+func Test_StatQueue(t *testing.T) {
+	posix_mq.ForceRemoveQueue("pmq_testing_qstat")
+	mq := SampleMessageQueue(t, 0, "qstat")
+
+	qi, err := posix_mq.Stat("pmq_testing_qstat")
+	assertNil(t, err)
+	assertEqual(t, "pmq_testing_qstat", qi.Name)
+	assertEqual(t, posix_mq.POSIX_MQ_DIR+"pmq_testing_qstat", qi.Path)
+	assertEqual(t, int64(0), qi.Size)
+	//the umask may clear group bits
+	assertEqual(t, os.FileMode(0600), qi.Mode.Perm()&0600)
+	assertEqual(t, uint32(os.Getuid()), qi.UID)
+	assertTrue(t, !qi.Notified())
+
+	assertNil(t, mq.Send([]byte(wired), 0))
+	//the queue is not empty, so registering does not raise the signal
+	assertNil(t, mq.Notify(syscall.SIGUSR1))
+
+	qi, err = posix_mq.Stat("/pmq_testing_qstat")
+	assertNil(t, err)
+	assertTrue(t, qi.Size >= int64(len(wired)))
+	assertTrue(t, qi.Notified())
+	assertEqual(t, os.Getpid(), qi.NotifyPID)
+	assertEqual(t, posix_mq.NotifySignal, qi.NotifyMethod)
+	assertEqual(t, int(syscall.SIGUSR1), qi.NotifySigNo)
+
+	queues, err := posix_mq.ListQueues("")
+	assertNil(t, err)
+	var found bool
+	for _, q := range queues {
+		if q.Name == "pmq_testing_qstat" {
+			found = true
+			assertEqual(t, qi.Size, q.Size)
+		}
+	}
+	assertTrue(t, found)
+
+	err = mq.Unlink()
+	assertNil(t, err)
+
+	_, err = posix_mq.Stat("pmq_testing_qstat")
+	assertTrue(t, errors.Is(err, posix_mq.ErrNotFound))
+	_, err = posix_mq.ListQueues("/nonexistent/mqueue")
+	assertTrue(t, errors.Is(err, posix_mq.ErrNotFound))
+}
+func Test_Notify(t *testing.T) {
+	mq := SampleMessageQueue(t, 0, "qnot")
+
+	mq.Notify(syscall.SIGUSR1)
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGUSR1)
+	var signalsCaught atomic.Int32
+	go func(test *testing.T) {
+		for {
+			s := <-sigc
+			switch s {
+			case syscall.SIGUSR1:
+				test.Logf("catched signal: %-v", s)
+
+				response, _, err := mq.Receive()
+
+				if err != nil {
+					test.Error(err)
+				}
+
+				if wired != string(response) {
 					test.Errorf("expected %s, got: %s", wired, response)
 				} else {
 					test.Logf("Sucessfully notified with msg: %s", response)
-					signalsCaught++
+					signalsCaught.Add(1)
 				}
 			default:
 				t.Logf("Caught an unexpected signal: %s", s)
 			}
-			if signalsCaught >= 2 {
+			if signalsCaught.Load() >= 2 {
 				break
 			}
 			time.Sleep(1 * time.Second)
@@ -408,60 +1779,425 @@ func Test_Notify(t *testing.T) {
 
 	time.Sleep(1 * time.Second)
 
-	if signalsCaught != 2 {
-		t.Errorf("expected catching 2 notifications, got: %d", signalsCaught)
+	if caught := signalsCaught.Load(); caught != 2 {
+		t.Errorf("expected catching 2 notifications, got: %d", caught)
 	}
 
 	err := mq.Unlink()
 	assertNil(t, err)
 }
 
-func Test_QueueClose(t *testing.T) {
-	mq := SampleMessageQueue(t, 0, "qcls")
-	if err := mq.Close(); err != nil {
-		t.Errorf("expected to close queue, got: %s", err)
-	}
-	if err := mq.Send([]byte("I'll never be sent :("), 0); err != nil {
-		switch err {
-		case nil:
-			t.Error("Expected bad file descriptor error")
-		case syscall.EBADF:
-			t.Log("Received BAD file descriptor error")
+// a signal registration survives the calls waiting on the queue with a timeout or a context
+func Test_NotifyAfterTimedReceive(t *testing.T) {
+	posix_mq.ForceRemoveQueue("pmq_testing_qnottimed")
+	mq := SampleMessageQueue(t, 0, "qnottimed")
+	defer mq.Unlink()
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGUSR2)
+	defer signal.Stop(sigc)
+	assertNil(t, mq.Notify(syscall.SIGUSR2))
+
+	_, _, err := mq.TimedReceive(20 * time.Millisecond)
+	assertEqual(t, syscall.ETIMEDOUT, asErrno(err))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, _, err = mq.ReceiveContext(ctx)
+	assertTrue(t, errors.Is(err, context.DeadlineExceeded))
+
+	assertNil(t, mq.Send([]byte(wired), 0))
+	select {
+	case <-sigc:
+	case <-time.After(time.Second):
+		t.Fatal("expected a notification")
+	}
+}
+
+func Test_NotifyChan(t *testing.T) {
+	posix_mq.ForceRemoveQueue("pmq_testing_qnotchan")
+	mq := SampleMessageQueue(t, 0, "qnotchan")
+
+	notifications, cancel, err := mq.NotifyChan()
+	assertNil(t, err)
+	//only one registration may exist on a queue
+	_, _, err = mq.NotifyChan()
+	assertEqual(t, syscall.EBUSY, asErrno(err))
+	for i := 0; i < 3; i++ {
+		err = mq.Send([]byte(wired), 0)
+		assertNil(t, err)
+		expectNotification(t, notifications)
+		msg, _, err := mq.Receive()
+		assertNil(t, err)
+		assertEqual(t, wired, string(msg))
+	}
+
+	//timed calls that block leave the registration in place
+	_, _, err = mq.TimedReceive(10 * time.Millisecond)
+	assertEqual(t, syscall.ETIMEDOUT, asErrno(err))
+	err = mq.Send([]byte(wired), 0)
+	assertNil(t, err)
+	expectNotification(t, notifications)
+	_, _, err = mq.Receive()
+	assertNil(t, err)
+
+	//closing another descriptor of the queue drops the kernel registration, which is re-armed
+	other := SampleMessageQueue(t, 0, "qnotchan")
+	assertNil(t, other.Close())
+	time.Sleep(10 * time.Millisecond)
+	err = mq.Send([]byte(wired), 0)
+	assertNil(t, err)
+	expectNotification(t, notifications)
+
+	cancel()
+	cancel()
+	for range notifications {
+	}
+	_, cancel, err = mq.NotifyChan()
+	assertNil(t, err)
+	cancel()
+
+	err = mq.Unlink()
+	assertNil(t, err)
+}
+
+// messages already on the queue at registration are notified
+func Test_NotifyChanPending(t *testing.T) {
+	posix_mq.ForceRemoveQueue("pmq_testing_qnotpend")
+	mq := SampleMessageQueue(t, 0, "qnotpend")
+
+	err := mq.Send([]byte(wired), 0)
+	assertNil(t, err)
+	notifications, _, err := mq.NotifyChan()
+	assertNil(t, err)
+	expectNotification(t, notifications)
+
+	//closing the queue ends the notifications
+	err = mq.Unlink()
+	assertNil(t, err)
+	select {
+	case _, ok := <-notifications:
+		if ok {
+			t.Error("expected the notification channel to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Error("expected the notification channel to be closed")
+	}
+}
+
+func Test_NotifyFunc(t *testing.T) {
+	posix_mq.ForceRemoveQueue("pmq_testing_qnotfunc")
+	mq := SampleMessageQueue(t, 0, "qnotfunc")
+
+	notifications := make(chan struct{}, 1)
+	cancel, err := mq.NotifyFunc(func() {
+		select {
+		case notifications <- struct{}{}:
 		default:
-			t.Fatalf("got an unexpected error %s", err)
 		}
+	})
+	assertNil(t, err)
+	for i := 0; i < 3; i++ {
+		err = mq.Send([]byte(wired), 0)
+		assertNil(t, err)
+		expectNotification(t, notifications)
+		msg, _, err := mq.Receive()
+		assertNil(t, err)
+		assertEqual(t, wired, string(msg))
 	}
-	if _, err := os.Stat(posix_mq.POSIX_MQ_DIR + "pmq_testing_qcls"); err != nil {
-		t.Errorf("got an unexpected error %s", err)
+	cancel()
+
+	err = mq.Unlink()
+	assertNil(t, err)
+}
+
+func expectNotification(t *testing.T, notifications <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-notifications:
+	case <-time.After(time.Second):
+		t.Fatal("expected a notification")
+	}
+}
+
+func Test_QueueClose(t *testing.T) {
+	forEachQueueImpl(t, func(t *testing.T, impl queueImpl) {
+		mq := sampleQueue(t, impl, 0, "qcls")
+		if err := mq.Close(); err != nil {
+			t.Errorf("expected to close queue, got: %s", err)
+		}
+		if err := mq.Send([]byte("I'll never be sent :("), 0); err != nil {
+			switch {
+			case err == nil:
+				t.Error("Expected bad file descriptor error")
+			case errors.Is(err, syscall.EBADF):
+				t.Log("Received BAD file descriptor error")
+			default:
+				t.Fatalf("got an unexpected error %s", err)
+			}
+		}
+		//closing leaves the queue in place
+		reopened, err := impl.open(&posix_mq.QueueConfig{Name: "pmq_testing_qcls", Flags: posix_mq.O_RDONLY})
+		if err != nil {
+			t.Errorf("got an unexpected error %s", err)
+		} else {
+			reopened.Close()
+		}
+		err = impl.remove("pmq_testing_qcls")
+		assertNil(t, err)
+	})
+}
+
+// closing twice is a no-op and every operation on a closed queue fails with ErrClosed
+func Test_QueueCloseTwice(t *testing.T) {
+	posix_mq.ForceRemoveQueue("pmq_testing_qcls2")
+	mq := SampleMessageQueue(t, 0, "qcls2")
+
+	err := mq.Close()
+	assertNil(t, err)
+	err = mq.Close()
+	assertNil(t, err)
+
+	err = mq.Send([]byte(wired), 0)
+	assertTrue(t, errors.Is(err, posix_mq.ErrClosed))
+	_, _, err = mq.Receive()
+	assertTrue(t, errors.Is(err, posix_mq.ErrClosed))
+	_, _, err = mq.TimedReceive(time.Second)
+	assertTrue(t, errors.Is(err, posix_mq.ErrClosed))
+	_, _, err = mq.ReceiveContext(context.Background())
+	assertTrue(t, errors.Is(err, posix_mq.ErrClosed))
+	_, _, err = mq.ReceiveInto(make([]byte, mq.MaxMessageSize()))
+	assertTrue(t, errors.Is(err, posix_mq.ErrClosed))
+	_, err = mq.GetAttr()
+	assertTrue(t, errors.Is(err, posix_mq.ErrClosed))
+	_, err = mq.Count()
+	assertTrue(t, errors.Is(err, posix_mq.ErrClosed))
+	err = mq.Notify(syscall.SIGUSR1)
+	assertTrue(t, errors.Is(err, posix_mq.ErrClosed))
+	err = mq.SetDeadline(time.Now())
+	assertTrue(t, errors.Is(err, posix_mq.ErrClosed))
+
+	//unlinking a closed queue still deletes it
+	err = mq.Unlink()
+	assertNil(t, err)
+	_, err = os.Stat(posix_mq.POSIX_MQ_DIR + "pmq_testing_qcls2")
+	assertTrue(t, os.IsNotExist(err))
+	err = mq.Unlink()
+	assertTrue(t, errors.Is(err, posix_mq.ErrNotFound))
+}
+
+// a queue dropped without being closed has its descriptor released by the garbage collector
+func Test_QueueFinalizer(t *testing.T) {
+	posix_mq.ForceRemoveQueue("pmq_testing_qfin")
+	fds := openFds(t)
+	SampleMessageQueue(t, 0, "qfin")
+	assertEqual(t, fds+1, openFds(t))
+
+	for i := 0; i < 10 && openFds(t) > fds; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
 	}
-	err := posix_mq.ForceRemoveQueue("pmq_testing_qcls")
+	assertEqual(t, fds, openFds(t))
+
+	err := posix_mq.ForceRemoveQueue("pmq_testing_qfin")
 	assertNil(t, err)
 }
 
+func openFds(t *testing.T) int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	assertNil(t, err)
+	return len(entries)
+}
+
 func Test_QueueUnlink(t *testing.T) {
-	mq := SampleMessageQueue(t, 0, "qulnk")
-	if err := mq.Unlink(); err != nil {
-		t.Errorf("expected to close queue, got: %s", err)
-	}
-	if err := mq.Send([]byte("I'll never be sent :("), 0); err != nil {
-		switch err {
-		case nil:
-			t.Error("Expected bad file descriptor error")
-		case syscall.EBADF:
-			t.Log("Received BAD file descriptor error")
-		default:
-			t.Fatalf("got an unexpected error %s", err)
+	forEachQueueImpl(t, func(t *testing.T, impl queueImpl) {
+		mq := sampleQueue(t, impl, 0, "qulnk")
+		if err := mq.Unlink(); err != nil {
+			t.Errorf("expected to close queue, got: %s", err)
+		}
+		if err := mq.Send([]byte("I'll never be sent :("), 0); err != nil {
+			switch {
+			case err == nil:
+				t.Error("Expected bad file descriptor error")
+			case errors.Is(err, syscall.EBADF):
+				t.Log("Received BAD file descriptor error")
+			default:
+				t.Fatalf("got an unexpected error %s", err)
+			}
+		}
+		_, err := impl.open(&posix_mq.QueueConfig{Name: "pmq_testing_qulnk", Flags: posix_mq.O_RDONLY})
+		assertEqual(t, syscall.ENOENT, asErrno(err))
+	})
+}
+
+func BenchmarkSendReceive(b *testing.B) {
+	mq := benchmarkQueue(b, "benchsendrcv")
+	msg := []byte(wired)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := mq.Send(msg, 0); err != nil {
+			b.Fatal(err)
+		}
+		if _, _, err := mq.Receive(); err != nil {
+			b.Fatal(err)
 		}
 	}
-	if _, err := os.Stat(posix_mq.POSIX_MQ_DIR + "pmq_testing_qulnk"); err != nil {
-		if os.IsNotExist(err) {
-			t.Log("Expected file to not exist")
-		} else {
-			t.Fatalf("got an unexpected error %s", err)
+}
+
+// with caller-owned buffers the message moves without any allocation
+func BenchmarkSendReceiveInto(b *testing.B) {
+	mq := benchmarkQueue(b, "benchsendrcvinto")
+	msg := []byte(wired)
+	buf := make([]byte, 1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := mq.Send(msg, 0); err != nil {
+			b.Fatal(err)
 		}
+		if _, _, err := mq.ReceiveInto(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkQueue(b *testing.B, postfix string) *posix_mq.MessageQueue {
+	name := "pmq_testing_" + postfix
+	posix_mq.ForceRemoveQueue(name)
+	mq, err := posix_mq.NewMessageQueue(&posix_mq.QueueConfig{
+		Name:  name,
+		Mode:  0660,
+		Flags: posix_mq.O_RDWR | posix_mq.O_CREAT,
+		Attrs: &posix_mq.MessageQueueAttribute{
+			MaxMsg:  10,
+			MsgSize: 1024,
+		},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		mq.Unlink()
+	})
+	return mq
+}
+
+func Test_OpError(t *testing.T) {
+	posix_mq.ForceRemoveQueue("pmq_testing_operr")
+	config := posix_mq.QueueConfig{
+		Name:  "pmq_testing_operr",
+		Mode:  0660,
+		Flags: posix_mq.O_RDWR | posix_mq.O_NONBLOCK,
+		Attrs: &posix_mq.MessageQueueAttribute{
+			MaxMsg:  1,
+			MsgSize: len(wired),
+		},
+	}
+	mq, err := posix_mq.NewMessageQueue(&config)
+	assertNil(t, mq)
+	assertTrue(t, errors.Is(err, posix_mq.ErrNotFound))
+	var opErr *posix_mq.OpError
+	assertTrue(t, errors.As(err, &opErr))
+	assertEqual(t, "open", opErr.Op)
+	assertEqual(t, "/pmq_testing_operr", opErr.Name)
+	assertEqual(t, "posix_mq: open /pmq_testing_operr: no such file or directory", err.Error())
+
+	config.Flags |= posix_mq.O_CREAT
+	mq, err = posix_mq.NewMessageQueue(&config)
+	assertNil(t, err)
+	config.Flags |= posix_mq.O_EXCL
+	_, err = posix_mq.NewMessageQueue(&config)
+	assertTrue(t, errors.Is(err, posix_mq.ErrExists))
+
+	_, _, err = mq.Receive()
+	assertTrue(t, errors.Is(err, posix_mq.ErrQueueEmpty))
+	assertTrue(t, !errors.Is(err, posix_mq.ErrQueueFull))
+	assertTrue(t, errors.As(err, &opErr))
+	assertTrue(t, opErr.Temporary())
+	err = mq.Send([]byte(wired+wired), 0)
+	assertTrue(t, errors.Is(err, posix_mq.ErrMessageTooLarge))
+	err = mq.Send([]byte(wired), 0)
+	assertNil(t, err)
+	err = mq.Send([]byte(wired), 0)
+	assertTrue(t, errors.Is(err, posix_mq.ErrQueueFull))
+	assertTrue(t, !errors.Is(err, posix_mq.ErrQueueEmpty))
+
+	_, err = mq.SetNonblocking(false)
+	assertNil(t, err)
+	err = mq.TimedSend([]byte(wired), 0, 10*time.Millisecond)
+	assertTrue(t, errors.Is(err, posix_mq.ErrTimeout))
+	assertTrue(t, errors.As(err, &opErr))
+	assertTrue(t, opErr.Timeout())
+
+	err = mq.Close()
+	assertNil(t, err)
+	err = mq.Send([]byte(wired), 0)
+	assertTrue(t, errors.Is(err, posix_mq.ErrClosed))
+	err = posix_mq.ForceRemoveQueue("pmq_testing_operr")
+	assertNil(t, err)
+	err = posix_mq.ForceRemoveQueue("pmq_testing_operr")
+	assertTrue(t, errors.Is(err, posix_mq.ErrNotFound))
+
+	config.Name = "/pmq_testing_operr"
+	_, err = posix_mq.NewMessageQueue(&config)
+	assertTrue(t, errors.Is(err, posix_mq.ErrPermission))
+}
+
+// queueImpl opens and removes the queues of a Queue implementation, the tests using only Queue run against each.
+type queueImpl struct {
+	name   string
+	open   func(config *posix_mq.QueueConfig) (posix_mq.Queue, error)
+	remove func(name string) error
+}
+
+var queueImpls = []queueImpl{
+	{
+		name: "posix",
+		open: func(config *posix_mq.QueueConfig) (posix_mq.Queue, error) {
+			mq, err := posix_mq.NewMessageQueue(config)
+			if err != nil {
+				return nil, err
+			}
+			return mq, nil
+		},
+		remove: posix_mq.ForceRemoveQueue,
+	},
+	{
+		name: "memory",
+		open: func(config *posix_mq.QueueConfig) (posix_mq.Queue, error) {
+			mq, err := posix_mq.NewMemoryQueue(config)
+			if err != nil {
+				return nil, err
+			}
+			return mq, nil
+		},
+		remove: posix_mq.RemoveMemoryQueue,
+	},
+}
+
+func forEachQueueImpl(t *testing.T, test func(t *testing.T, impl queueImpl)) {
+	for _, impl := range queueImpls {
+		t.Run(impl.name, func(t *testing.T) {
+			test(t, impl)
+		})
 	}
 }
 
+// sampleQueue is SampleMessageQueue for the queues of impl.
+func sampleQueue(t *testing.T, impl queueImpl, flags int, postfix string) posix_mq.Queue {
+	if flags == 0 {
+		flags = posix_mq.O_RDWR | posix_mq.O_CREAT
+	}
+	mqt, err := impl.open(&posix_mq.QueueConfig{
+		Name:  fmt.Sprintf("pmq_testing_%s", postfix),
+		Mode:  0660,
+		Flags: flags,
+	})
+	assertNil(t, err)
+	assertNotNil(t, mqt)
+	return mqt
+}
+
 func SampleMessageQueue(t *testing.T, flags int, postfix string) *posix_mq.MessageQueue {
 
 	if flags == 0 {
@@ -479,6 +2215,13 @@ func SampleMessageQueue(t *testing.T, flags int, postfix string) *posix_mq.Messa
 	return mqt
 }
 
+// asErrno returns the syscall.Errno err wraps, or 0 when it wraps none.
+func asErrno(err error) syscall.Errno {
+	var errno syscall.Errno
+	errors.As(err, &errno)
+	return errno
+}
+
 func assertNil(t *testing.T, i interface{}) {
 	if !isNil(i) {
 		t.Errorf("expected %-v to be nil", i)
@@ -0,0 +1,191 @@
+package posix_mq
+
+import (
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// NotifyChan and NotifyFunc use the kernel side of SIGEV_THREAD directly: rather than a signal,
+// each notification is a cookie written to a netlink socket, which is read through the runtime poller.
+
+const (
+	sigevSignal = 0
+	sigevThread = 2
+
+	notifyCookieLen = 32
+	notifyWokenUp   = 1
+	notifyRemoved   = 2
+)
+
+// sigevent mirrors struct sigevent, which the kernel always treats as 64 bytes.
+type sigevent struct {
+	value  uintptr
+	signo  int32
+	notify int32
+	_      [64 - 8 - unsafe.Sizeof(uintptr(0))]byte
+}
+
+type notifier struct {
+	mq     *MessageQueue
+	sock   *os.File
+	cookie [notifyCookieLen]byte
+	fire   func()
+
+	mu         sync.Mutex // serializes re-arming with cancel
+	registered bool       // whether the registration on the queue belongs to n
+	canceled   bool
+}
+
+// NotifyChan registers for notification of new messages and delivers them on the returned channel.
+//
+// A notification is sent whenever a message arrives on an empty queue, and also when the queue already holds messages
+// at registration, so a receiver draining the queue after each notification will not miss any message.
+// Notifications are coalesced while the channel holds one that has not been received yet.
+// The registration is re-armed after each delivery until cancel is called or the queue is closed,
+// at which point the channel is closed.
+//
+// Only one registration may exist per queue across all processes, otherwise registering fails with syscall.EBUSY.
+func (mq *MessageQueue) NotifyChan() (<-chan struct{}, func(), error) {
+	c := make(chan struct{}, 1)
+	n, err := mq.startNotifier(func() {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		return nil, nil, mq.opError("notify", err)
+	}
+
+	go func() {
+		defer close(c)
+		n.run()
+	}()
+	return c, n.cancel, nil
+}
+
+// NotifyFunc registers fn to be called, on a goroutine of its own, whenever a message arrives on an empty queue,
+// in the manner of SIGEV_THREAD.
+// It is otherwise the same as NotifyChan.
+func (mq *MessageQueue) NotifyFunc(fn func()) (func(), error) {
+	n, err := mq.startNotifier(func() {
+		go fn()
+	})
+	if err != nil {
+		return nil, mq.opError("notify", err)
+	}
+
+	go n.run()
+	return n.cancel, nil
+}
+
+func (mq *MessageQueue) startNotifier(fire func()) (*notifier, error) {
+	sock, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	n := &notifier{
+		mq:   mq,
+		sock: os.NewFile(uintptr(sock), "mq_notify"),
+		fire: fire,
+	}
+	if err := n.register(); err != nil {
+		n.sock.Close()
+		return nil, err
+	}
+	return n, nil
+}
+
+// run delivers notifications until the registration is cancelled or cannot be re-armed.
+func (n *notifier) run() {
+	defer n.cancel()
+
+	n.fireIfPending()
+	var cookie [notifyCookieLen]byte
+	for {
+		if _, err := n.sock.Read(cookie[:]); err != nil {
+			return
+		}
+		switch cookie[notifyCookieLen-1] {
+		case notifyWokenUp:
+			n.fire()
+		case notifyRemoved:
+			//closing any descriptor of the queue in this process drops the registration
+		default:
+			continue
+		}
+
+		n.mu.Lock()
+		n.registered = false
+		if n.canceled {
+			n.mu.Unlock()
+			return
+		}
+		err := n.register()
+		n.mu.Unlock()
+		if err != nil {
+			return
+		}
+		//messages that arrived before re-arming did not notify
+		n.fireIfPending()
+	}
+}
+
+func (n *notifier) fireIfPending() {
+	if attr, err := n.mq.GetAttr(); err == nil && attr.MsgCnt > 0 {
+		n.fire()
+	}
+}
+
+func (n *notifier) register() error {
+	conn, err := n.sock.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var notifyErr error
+	if err := conn.Control(func(sock uintptr) {
+		notifyErr = n.mq.notifyRaw(&sigevent{
+			value:  uintptr(unsafe.Pointer(&n.cookie[0])),
+			signo:  int32(sock),
+			notify: sigevThread,
+		})
+	}); err != nil {
+		return err
+	}
+	runtime.KeepAlive(n)
+	n.registered = notifyErr == nil
+	return notifyErr
+}
+
+// cancel removes the registration and stops delivering notifications.
+func (n *notifier) cancel() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.canceled {
+		return
+	}
+	n.canceled = true
+	//the kernel only knows the owning process, so leave a registration made by someone else alone
+	if n.registered {
+		n.mq.notifyRaw(nil)
+	}
+	n.sock.Close()
+}
+
+// notifyRaw calls mq_notify(2) on the queue descriptor, a nil sigEvent removes the registration.
+func (mq *MessageQueue) notifyRaw(sigEvent *sigevent) error {
+	var errno syscall.Errno
+	if err := mq.conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_MQ_NOTIFY, fd, uintptr(unsafe.Pointer(sigEvent)), 0)
+	}); err != nil {
+		return mq.connError(err)
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+// Package posix_mqtest provides message queues for tests: uniquely named, removed when the test ends,
+// and assertions on their state.
+//
+// The queues are named after the test and the PID of the test binary, so that parallel tests and
+// concurrent test binaries never collide, and the queues left behind by a test binary can be told apart.
+package posix_mqtest
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nidhhoggr/posix_mq"
+	"github.com/nidhhoggr/posix_mq/internal/pidsweep"
+)
+
+// Prefix starts the names given by Name, followed by the PID of the test binary.
+const Prefix = "posix_mqtest."
+
+// ReceiveTimeout bounds the wait of AssertReceives on a blocking queue.
+var ReceiveTimeout = 5 * time.Second
+
+// Options is used to configure the queues of NewTestQueue, zero values meaning the defaults.
+type Options struct {
+	Flags int // O_RDWR | O_CREAT | O_EXCL by default, O_CREAT is always added
+	Mode  int // 0600 by default
+	Attrs *posix_mq.MessageQueueAttribute
+}
+
+// names numbers the names given by Name in the test binary.
+var names atomic.Uint64
+
+// Name returns a queue name unique to the test binary, derived from the name of t.
+// When t ends the queue must have been removed: a queue left behind is reported as a test error and removed.
+func Name(t testing.TB) string {
+	t.Helper()
+	name := uniqueName(t)
+	t.Cleanup(func() {
+		//os.Stat does not open the queue file, whose closing would drop the Notify registrations of the test
+		if _, err := os.Stat(posix_mq.POSIX_MQ_DIR + name); err == nil {
+			t.Errorf("posix_mqtest: queue %s left behind", name)
+			posix_mq.ForceRemoveQueue(name)
+		}
+	})
+	return name
+}
+
+func uniqueName(t testing.TB) string {
+	name := Prefix + strconv.Itoa(os.Getpid()) + "." + strconv.FormatUint(names.Add(1), 10) + "." +
+		strings.ReplaceAll(t.Name(), "/", "_")
+	return name[:min(len(name), 255)] // NAME_MAX
+}
+
+// NewTestQueue creates a queue named by Name, which is unlinked when t ends. A failure to create it is fatal.
+func NewTestQueue(t testing.TB, opts *Options) *posix_mq.MessageQueue {
+	t.Helper()
+	config := queueConfig(Name(t), opts)
+	mq, err := posix_mq.NewMessageQueue(config)
+	if err != nil {
+		t.Fatalf("posix_mqtest: %s", err)
+	}
+	t.Cleanup(func() {
+		if err := mq.Unlink(); err != nil && !errors.Is(err, posix_mq.ErrNotFound) {
+			t.Errorf("posix_mqtest: %s", err)
+		}
+	})
+	return mq
+}
+
+// NewTestMemoryQueue is NewTestQueue for a MemoryQueue.
+func NewTestMemoryQueue(t testing.TB, opts *Options) *posix_mq.MemoryQueue {
+	t.Helper()
+	mq, err := posix_mq.NewMemoryQueue(queueConfig(uniqueName(t), opts))
+	if err != nil {
+		t.Fatalf("posix_mqtest: %s", err)
+	}
+	t.Cleanup(func() {
+		mq.Unlink()
+	})
+	return mq
+}
+
+func queueConfig(name string, opts *Options) *posix_mq.QueueConfig {
+	config := &posix_mq.QueueConfig{
+		Name:  name,
+		Flags: posix_mq.O_RDWR | posix_mq.O_EXCL,
+		Mode:  0600,
+	}
+	if opts != nil {
+		if opts.Flags != 0 {
+			config.Flags = opts.Flags
+		}
+		if opts.Mode != 0 {
+			config.Mode = opts.Mode
+		}
+		config.Attrs = opts.Attrs
+	}
+	config.Flags |= posix_mq.O_CREAT
+	return config
+}
+
+// AssertCount checks that q holds count messages.
+func AssertCount(t testing.TB, q posix_mq.Queue, count int) {
+	t.Helper()
+	attr, err := q.GetAttr()
+	if err != nil {
+		t.Errorf("posix_mqtest: %s", err)
+		return
+	}
+	if attr.MsgCnt != count {
+		t.Errorf("posix_mqtest: queue holds %d messages, expected %d", attr.MsgCnt, count)
+	}
+}
+
+// AssertEmpty checks that q holds no message.
+func AssertEmpty(t testing.TB, q posix_mq.Queue) {
+	t.Helper()
+	AssertCount(t, q, 0)
+}
+
+// AssertReceives receives a message from q, waiting up to ReceiveTimeout, and checks it is msg with priority prio.
+func AssertReceives(t testing.TB, q posix_mq.Queue, msg []byte, prio uint) {
+	t.Helper()
+	got, gotPrio, err := q.TimedReceive(ReceiveTimeout)
+	if err != nil {
+		t.Errorf("posix_mqtest: %s", err)
+		return
+	}
+	if string(got) != string(msg) || gotPrio != prio {
+		t.Errorf("posix_mqtest: received %q with priority %d, expected %q with priority %d", got, gotPrio, msg, prio)
+	}
+}
+
+// VerifyNoLeaks runs the tests of m and fails the test binary when queues named by Name are left behind,
+// removing them. It is meant to be called from TestMain:
+//
+//	func TestMain(m *testing.M) {
+//		posix_mqtest.VerifyNoLeaks(m)
+//	}
+//
+// Before running the tests it removes the queues left behind by test binaries that are not running anymore.
+func VerifyNoLeaks(m *testing.M) {
+	if _, err := pidsweep.Sweep(Prefix, pidsweep.Gone); err != nil {
+		fmt.Fprintln(os.Stderr, "posix_mqtest:", err)
+	}
+	code := m.Run()
+	leaked, err := pidsweep.Sweep(Prefix, func(pid int) bool { return pid == os.Getpid() })
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "posix_mqtest:", err)
+	}
+	for _, name := range leaked {
+		fmt.Fprintf(os.Stderr, "posix_mqtest: queue %s left behind\n", name)
+	}
+	if code == 0 && (len(leaked) > 0 || err != nil) {
+		code = 1
+	}
+	os.Exit(code)
+}
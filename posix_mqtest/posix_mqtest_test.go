@@ -0,0 +1,109 @@
+package posix_mqtest_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/nidhhoggr/posix_mq"
+	"github.com/nidhhoggr/posix_mq/posix_mqtest"
+)
+
+func TestMain(m *testing.M) {
+	posix_mqtest.VerifyNoLeaks(m)
+}
+
+// recorder collects the errors of the helpers, running the cleanups they register when finished.
+type recorder struct {
+	testing.TB
+	errors   []string
+	cleanups []func()
+}
+
+func (r *recorder) Errorf(format string, args ...any) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *recorder) Cleanup(f func()) {
+	r.cleanups = append(r.cleanups, f)
+}
+
+func (r *recorder) finish() {
+	for i := len(r.cleanups) - 1; i >= 0; i-- {
+		r.cleanups[i]()
+	}
+}
+
+func TestNewTestQueue(t *testing.T) {
+	var name string
+	t.Run("sub", func(t *testing.T) {
+		mq := posix_mqtest.NewTestQueue(t, nil)
+		name = mq.Name()
+		if _, err := posix_mq.Stat(name); err != nil {
+			t.Fatal(err)
+		}
+		prefix := posix_mqtest.Prefix + strconv.Itoa(os.Getpid()) + "."
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".TestNewTestQueue_sub") {
+			t.Errorf("unexpected name %s", name)
+		}
+		assertQueue(t, mq)
+	})
+	if _, err := posix_mq.Stat(name); !errors.Is(err, posix_mq.ErrNotFound) {
+		t.Errorf("expected %s to be removed, got %v", name, err)
+	}
+}
+
+func TestNewTestMemoryQueue(t *testing.T) {
+	assertQueue(t, posix_mqtest.NewTestMemoryQueue(t, nil))
+}
+
+func assertQueue(t *testing.T, q posix_mq.Queue) {
+	posix_mqtest.AssertEmpty(t, q)
+	if err := q.Send([]byte("low"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Send([]byte("high"), 2); err != nil {
+		t.Fatal(err)
+	}
+	posix_mqtest.AssertCount(t, q, 2)
+	posix_mqtest.AssertReceives(t, q, []byte("high"), 2)
+	posix_mqtest.AssertReceives(t, q, []byte("low"), 1)
+	posix_mqtest.AssertEmpty(t, q)
+}
+
+// a queue left behind is reported and removed
+func TestNameLeak(t *testing.T) {
+	r := &recorder{TB: t}
+	name := posix_mqtest.Name(r)
+	mq, err := posix_mq.NewMessageQueue(&posix_mq.QueueConfig{
+		Name:  name,
+		Flags: posix_mq.O_RDWR | posix_mq.O_CREAT,
+		Mode:  0600,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mq.Close()
+	r.finish()
+	if len(r.errors) != 1 || !strings.Contains(r.errors[0], "left behind") {
+		t.Errorf("expected the queue to be reported, got %q", r.errors)
+	}
+	if _, err := posix_mq.Stat(name); !errors.Is(err, posix_mq.ErrNotFound) {
+		t.Errorf("expected %s to be removed, got %v", name, err)
+	}
+}
+
+func TestAssertionsFail(t *testing.T) {
+	q := posix_mqtest.NewTestMemoryQueue(t, &posix_mqtest.Options{Flags: posix_mq.O_RDWR | posix_mq.O_NONBLOCK})
+	q.Send([]byte("sent"), 3)
+	r := &recorder{TB: t}
+	posix_mqtest.AssertEmpty(r, q)
+	posix_mqtest.AssertReceives(r, q, []byte("other"), 3)
+	posix_mqtest.AssertReceives(r, q, []byte("sent"), 3)
+	if len(r.errors) != 3 {
+		t.Errorf("expected 3 errors, got %q", r.errors)
+	}
+}
@@ -0,0 +1,20 @@
+package posix_mq
+
+import "time"
+
+// Queue holds the operations shared by MessageQueue and MemoryQueue,
+// so that code written against it can be tested without /dev/mqueue.
+type Queue interface {
+	Send(data []byte, priority uint) error
+	TimedSend(data []byte, priority uint, duration time.Duration) error
+	Receive() ([]byte, uint, error)
+	TimedReceive(duration time.Duration) ([]byte, uint, error)
+	GetAttr() (*MessageQueueAttribute, error)
+	Close() error
+	Unlink() error
+}
+
+var (
+	_ Queue = (*MessageQueue)(nil)
+	_ Queue = (*MemoryQueue)(nil)
+)
@@ -0,0 +1,70 @@
+package posix_mq
+
+import (
+	"context"
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	DefaultRetryMaxAttempts    = 3
+	DefaultRetryInitialBackoff = 100 * time.Millisecond
+	DefaultRetryMaxBackoff     = 10 * time.Second
+	DefaultRetryMultiplier     = 2
+	DefaultRetryJitter         = 0.2
+)
+
+// RetryPolicy tells a Consumer how often and when to handle a failed message again, zero values meaning the defaults.
+// The backoff before attempt n+1 is InitialBackoff * Multiplier^(n-1), at most MaxBackoff,
+// shortened by a random fraction of up to Jitter of it so that failed messages do not retry in lockstep.
+type RetryPolicy struct {
+	MaxAttempts    int           // Attempts at handling a message, the first one included
+	InitialBackoff time.Duration // Backoff after the first attempt
+	MaxBackoff     time.Duration // Ceiling of the backoff
+	Multiplier     float64       // Growth of the backoff from one attempt to the next
+	Jitter         float64       // Fraction of the backoff randomised, between 0 and 1; negative for none
+}
+
+// Backoff returns the time to wait after the given attempt, counted from 1, before the next one.
+func (p *RetryPolicy) Backoff(attempt int) time.Duration {
+	policy := p.withDefaults()
+	backoff := float64(policy.InitialBackoff) * math.Pow(policy.Multiplier, float64(attempt-1))
+	backoff = min(backoff, float64(policy.MaxBackoff))
+	if policy.Jitter > 0 {
+		backoff -= backoff * min(policy.Jitter, 1) * rand.Float64()
+	}
+	return time.Duration(backoff)
+}
+
+func (p *RetryPolicy) withDefaults() RetryPolicy {
+	policy := *p
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = DefaultRetryMaxAttempts
+	}
+	if policy.InitialBackoff <= 0 {
+		policy.InitialBackoff = DefaultRetryInitialBackoff
+	}
+	if policy.MaxBackoff <= 0 {
+		policy.MaxBackoff = DefaultRetryMaxBackoff
+	}
+	if policy.Multiplier <= 0 {
+		policy.Multiplier = DefaultRetryMultiplier
+	}
+	if policy.Jitter == 0 {
+		policy.Jitter = DefaultRetryJitter
+	}
+	return policy
+}
+
+// sleepContext waits for d, returning false when ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
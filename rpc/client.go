@@ -0,0 +1,171 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nidhhoggr/posix_mq"
+)
+
+// ClientConfig is used to configure a Client.
+type ClientConfig struct {
+	Server string // Name of the request queue of the server
+	Mode   int    // The mode of the reply queue, 0600 when 0
+	Attrs  *posix_mq.MessageQueueAttribute
+}
+
+// Client calls the methods of a Server. A Client is safe for concurrent use by multiple goroutines.
+type Client struct {
+	requests *posix_mq.MessageQueue
+	replies  *posix_mq.MessageQueue
+	replyTo  string // name of the reply queue, prefixing the IDs of the requests
+	seq      atomic.Uint64
+
+	mu      sync.Mutex
+	pending map[string]chan *posix_mq.Message
+	err     error // set once the client stops reading replies
+	done    chan struct{}
+	closed  atomic.Bool
+}
+
+// replyQueues numbers the reply queues of the process.
+var replyQueues atomic.Uint64
+
+// NewClient opens the request queue of the server and creates the reply queue of the client.
+// Reply queues of clients that died without closing are removed by CleanupReplyQueues.
+func NewClient(config *ClientConfig) (*Client, error) {
+	requests, err := posix_mq.NewMessageQueue(&posix_mq.QueueConfig{
+		Name:  strings.TrimPrefix(config.Server, "/"),
+		Flags: posix_mq.O_WRONLY,
+	})
+	if err != nil {
+		return nil, err
+	}
+	mode := config.Mode
+	if mode == 0 {
+		mode = 0600
+	}
+	replyTo := replyQueueName(config.Server, os.Getpid(), replyQueues.Add(1))
+	replies, err := posix_mq.NewMessageQueue(&posix_mq.QueueConfig{
+		Name:  replyTo,
+		Flags: posix_mq.O_RDONLY | posix_mq.O_CREAT | posix_mq.O_EXCL,
+		Mode:  mode,
+		Attrs: config.Attrs,
+	})
+	if err != nil {
+		requests.Close()
+		return nil, err
+	}
+
+	c := &Client{
+		requests: requests,
+		replies:  replies,
+		replyTo:  replyTo,
+		pending:  make(map[string]chan *posix_mq.Message),
+		done:     make(chan struct{}),
+	}
+	go c.readReplies()
+	return c, nil
+}
+
+// Call sends req to method and waits for the reply until ctx is done.
+// The deadline of ctx is passed to the server, which skips the request once it has passed.
+// An error returned by the handler is a *RemoteError.
+func (c *Client) Call(ctx context.Context, method string, req []byte) ([]byte, error) {
+	id := c.replyTo + "/" + strconv.FormatUint(c.seq.Add(1), 10)
+	replyc := make(chan *posix_mq.Message, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.pending[id] = replyc
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	m := &posix_mq.Message{
+		ID: id,
+		Headers: map[string]string{
+			headerMethod:  method,
+			headerReplyTo: c.replyTo,
+		},
+		Data: req,
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		m.Headers[headerDeadline] = formatDeadline(deadline)
+	}
+	if err := c.requests.SendMessageContext(ctx, m); err != nil {
+		return nil, err
+	}
+
+	select {
+	case reply := <-replyc:
+		if msg, ok := reply.Headers[headerError]; ok {
+			return nil, &RemoteError{
+				Method:        method,
+				Message:       msg,
+				unknownMethod: reply.Headers[headerErrorCode] == errorCodeUnknownMethod,
+			}
+		}
+		return reply.Data, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, c.err
+	}
+}
+
+// readReplies hands the replies to the calls waiting for them, dropping those nobody waits for anymore.
+func (c *Client) readReplies() {
+	for {
+		reply, err := c.replies.ReceiveMessage()
+		var decodeErr *posix_mq.DecodeError
+		if errors.As(err, &decodeErr) {
+			continue
+		}
+		if err != nil {
+			if errors.Is(err, posix_mq.ErrClosed) {
+				err = ErrShutdown
+			}
+			c.mu.Lock()
+			c.err = err
+			c.mu.Unlock()
+			close(c.done)
+			return
+		}
+
+		c.mu.Lock()
+		replyc, ok := c.pending[reply.Headers[headerCorrelationID]]
+		c.mu.Unlock()
+		if ok {
+			select {
+			case replyc <- reply:
+			default: //a duplicate reply
+			}
+		}
+	}
+}
+
+// Close closes the request queue, and closes and removes the reply queue, failing the calls in progress with ErrShutdown.
+// Closing a closed client does nothing.
+func (c *Client) Close() error {
+	if c.closed.Swap(true) {
+		<-c.done
+		return nil
+	}
+	err := c.requests.Close()
+	if unlinkErr := c.replies.Unlink(); err == nil {
+		err = unlinkErr
+	}
+	<-c.done
+	return err
+}
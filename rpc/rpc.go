@@ -0,0 +1,80 @@
+// Package rpc implements request/reply calls over POSIX message queues.
+//
+// A Server reads requests from a named queue and dispatches them to the handler registered for their method.
+// Every Client owns a reply queue, named after the server and the PID of the client, where the server sends
+// the replies. Requests and replies travel in posix_mq envelopes, replies being matched to their call by the
+// ID of the request, and the deadline of a call is passed along so the server can skip requests nobody waits for.
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nidhhoggr/posix_mq/internal/pidsweep"
+)
+
+// Envelope headers of requests and replies.
+const (
+	headerMethod        = "rpc-method"
+	headerReplyTo       = "rpc-reply-to"
+	headerDeadline      = "rpc-deadline" // Unix nanoseconds
+	headerCorrelationID = "rpc-correlation-id"
+	headerError         = "rpc-error"
+	headerErrorCode     = "rpc-error-code"
+
+	errorCodeUnknownMethod = "unknown-method"
+)
+
+var (
+	// ErrShutdown is returned by calls on a closed Client.
+	ErrShutdown = errors.New("rpc: client is shut down")
+	// ErrUnknownMethod is matched by the RemoteError of a call to a method the server has no handler for.
+	ErrUnknownMethod = errors.New("rpc: unknown method")
+)
+
+// RemoteError is the error returned by a handler, as received by the Client.
+type RemoteError struct {
+	Method  string
+	Message string
+
+	unknownMethod bool
+}
+
+func (e *RemoteError) Error() string {
+	return "rpc: " + e.Method + ": " + e.Message
+}
+
+func (e *RemoteError) Is(target error) bool {
+	return target == ErrUnknownMethod && e.unknownMethod
+}
+
+// ReplyQueuePrefix returns the prefix of the names of the reply queues of the clients of server.
+func ReplyQueuePrefix(server string) string {
+	return strings.TrimPrefix(server, "/") + ".reply."
+}
+
+// replyQueueName returns the name of a reply queue of a client of server running as pid.
+func replyQueueName(server string, pid int, id uint64) string {
+	return fmt.Sprintf("%s%d.%d", ReplyQueuePrefix(server), pid, id)
+}
+
+// CleanupReplyQueues removes the reply queues of the clients of server whose process is gone,
+// left behind by clients that did not close. It returns the names of the removed queues.
+func CleanupReplyQueues(server string) ([]string, error) {
+	return pidsweep.Sweep(ReplyQueuePrefix(server), pidsweep.Gone)
+}
+
+func formatDeadline(deadline time.Time) string {
+	return strconv.FormatInt(deadline.UnixNano(), 10)
+}
+
+func parseDeadline(value string) (time.Time, bool) {
+	nanos, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos), true
+}
@@ -0,0 +1,219 @@
+package rpc_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nidhhoggr/posix_mq"
+	"github.com/nidhhoggr/posix_mq/rpc"
+)
+
+func startServer(t *testing.T, name string) *rpc.Server {
+	posix_mq.ForceRemoveQueue(name)
+	server, err := rpc.NewServer(&posix_mq.QueueConfig{Name: name, Mode: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.ErrorLog = log.New(io.Discard, "", 0)
+	server.Handle("echo", func(ctx context.Context, req []byte) ([]byte, error) {
+		return req, nil
+	})
+	server.Handle("fail", func(ctx context.Context, req []byte) ([]byte, error) {
+		return nil, errors.New("narwhal not found")
+	})
+	server.Handle("sleep", func(ctx context.Context, req []byte) ([]byte, error) {
+		time.Sleep(100 * time.Millisecond)
+		return req, nil
+	})
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(context.Background())
+	}()
+	t.Cleanup(func() {
+		server.Close()
+		if err := <-served; err != nil {
+			t.Error(err)
+		}
+		posix_mq.ForceRemoveQueue(name)
+	})
+	return server
+}
+
+func newClient(t *testing.T, server string) *rpc.Client {
+	client, err := rpc.NewClient(&rpc.ClientConfig{Server: server})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestCall(t *testing.T) {
+	startServer(t, "pmq_testing_rpc_call")
+	client := newClient(t, "pmq_testing_rpc_call")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := []byte(fmt.Sprintf("request %d", i))
+			reply, err := client.Call(context.Background(), "echo", req)
+			if err != nil {
+				t.Error(err)
+			} else if !bytes.Equal(req, reply) {
+				t.Errorf("expected reply %q, got: %q", req, reply)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestCallErrors(t *testing.T) {
+	startServer(t, "pmq_testing_rpc_errors")
+	client := newClient(t, "pmq_testing_rpc_errors")
+
+	_, err := client.Call(context.Background(), "fail", nil)
+	var remoteErr *rpc.RemoteError
+	if !errors.As(err, &remoteErr) || remoteErr.Message != "narwhal not found" {
+		t.Errorf("expected the error of the handler, got: %v", err)
+	}
+
+	_, err = client.Call(context.Background(), "missing", nil)
+	if !errors.Is(err, rpc.ErrUnknownMethod) {
+		t.Errorf("expected ErrUnknownMethod, got: %v", err)
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Call(context.Background(), "echo", nil); !errors.Is(err, rpc.ErrShutdown) {
+		t.Errorf("expected ErrShutdown, got: %v", err)
+	}
+	if err := client.Close(); err != nil {
+		t.Errorf("expected closing a closed client to do nothing, got: %v", err)
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	startServer(t, "pmq_testing_rpc_timeout")
+	client := newClient(t, "pmq_testing_rpc_timeout")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := client.Call(ctx, "sleep", []byte("late")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected DeadlineExceeded, got: %v", err)
+	}
+
+	//the late reply is dropped instead of answering the next call
+	reply, err := client.Call(context.Background(), "sleep", []byte("on time"))
+	if err != nil || string(reply) != "on time" {
+		t.Errorf("expected reply %q, got: %q, %v", "on time", reply, err)
+	}
+}
+
+// the server keeps the reply queues open, but replies to a queue that was removed and created again
+func TestReplyQueueReopened(t *testing.T) {
+	const server = "pmq_testing_rpc_reopen"
+	startServer(t, server)
+	requests, err := posix_mq.NewMessageQueue(&posix_mq.QueueConfig{Name: server, Flags: posix_mq.O_WRONLY})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer requests.Close()
+
+	replyTo := rpc.ReplyQueuePrefix(server) + "0.1"
+	for i := 0; i < 2; i++ {
+		posix_mq.ForceRemoveQueue(replyTo)
+		replies, err := posix_mq.NewMessageQueue(&posix_mq.QueueConfig{Name: replyTo, Flags: posix_mq.O_RDONLY | posix_mq.O_CREAT, Mode: 0600})
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := fmt.Sprintf("request %d", i)
+		err = requests.SendMessage(&posix_mq.Message{
+			ID:      id,
+			Headers: map[string]string{"rpc-method": "echo", "rpc-reply-to": replyTo},
+			Data:    []byte(id),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		reply, err := replies.ReceiveMessageContext(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("expected a reply to %s: %v", id, err)
+		}
+		if string(reply.Data) != id || reply.Headers["rpc-correlation-id"] != id {
+			t.Errorf("expected the reply to %s, got: %+v", id, reply)
+		}
+		replies.Unlink()
+	}
+}
+
+func TestCleanupReplyQueues(t *testing.T) {
+	const server = "pmq_testing_rpc_cleanup"
+	if _, err := rpc.CleanupReplyQueues(server); err != nil {
+		t.Fatal(err)
+	}
+	newClientWithoutServer(t, server)
+
+	//a reply queue left behind by a process that is gone
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	orphan := fmt.Sprintf("%s%d.1", rpc.ReplyQueuePrefix(server), cmd.Process.Pid)
+	mq, err := posix_mq.NewMessageQueue(&posix_mq.QueueConfig{Name: orphan, Flags: posix_mq.O_RDONLY | posix_mq.O_CREAT, Mode: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mq.Close()
+
+	removed, err := rpc.CleanupReplyQueues(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != orphan {
+		t.Errorf("expected removing %s, got: %v", orphan, removed)
+	}
+	if _, err := posix_mq.Stat(orphan); !errors.Is(err, posix_mq.ErrNotFound) {
+		t.Errorf("expected %s to be removed, got: %v", orphan, err)
+	}
+
+	//the reply queue of the running client is kept
+	queues, err := posix_mq.ListQueues("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept int
+	for _, q := range queues {
+		if strings.HasPrefix(q.Name, rpc.ReplyQueuePrefix(server)) {
+			kept++
+		}
+	}
+	if kept != 1 {
+		t.Errorf("expected the reply queue of the client to be kept, found %d reply queues", kept)
+	}
+}
+
+// newClientWithoutServer returns a client of a server queue that nobody serves.
+func newClientWithoutServer(t *testing.T, server string) *rpc.Client {
+	posix_mq.ForceRemoveQueue(server)
+	mq, err := posix_mq.NewMessageQueue(&posix_mq.QueueConfig{Name: server, Flags: posix_mq.O_RDONLY | posix_mq.O_CREAT, Mode: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mq.Unlink() })
+	return newClient(t, server)
+}
@@ -0,0 +1,237 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/nidhhoggr/posix_mq"
+)
+
+// Handler answers a request with a reply, or with an error passed on to the caller as a RemoteError.
+type Handler func(ctx context.Context, req []byte) ([]byte, error)
+
+// Server reads requests from its queue and dispatches them to the registered handlers,
+// each request being handled in its own goroutine.
+type Server struct {
+	// ErrorLog logs the requests that could not be answered, the standard logger is used when nil.
+	ErrorLog *log.Logger
+
+	name     string
+	queue    *posix_mq.MessageQueue
+	mu       sync.RWMutex
+	handlers map[string]Handler
+	inflight sync.WaitGroup
+
+	replyMu sync.RWMutex          // held for reading while sending a reply, so Close does not close the queue under it
+	replies map[string]replyQueue // open reply queues by name, nil once the server is closed
+}
+
+// replyQueue is a reply queue kept open by the server, along with the inode of the queue it was opened on.
+type replyQueue struct {
+	queue *posix_mq.MessageQueue
+	ino   uint64
+}
+
+// NewServer opens the request queue described by config, creating it if needed.
+// config.Flags is ignored, the queue is always opened with O_RDONLY | O_CREAT.
+func NewServer(config *posix_mq.QueueConfig) (*Server, error) {
+	queueConfig := *config
+	queueConfig.Flags = posix_mq.O_RDONLY | posix_mq.O_CREAT
+	queue, err := posix_mq.NewMessageQueue(&queueConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		name:     config.Name,
+		queue:    queue,
+		handlers: make(map[string]Handler),
+		replies:  make(map[string]replyQueue),
+	}, nil
+}
+
+// Queue returns the request queue of the server.
+func (s *Server) Queue() *posix_mq.MessageQueue {
+	return s.queue
+}
+
+// Handle registers handler for method, replacing the handler registered before if any.
+func (s *Server) Handle(method string, handler Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[method] = handler
+}
+
+// Serve handles requests until ctx is done or the server is closed, then waits for the handlers still running.
+// It returns nil when the server was closed and ctx.Err() when ctx is done.
+func (s *Server) Serve(ctx context.Context) error {
+	defer s.inflight.Wait()
+	for {
+		req, err := s.queue.ReceiveMessageContext(ctx)
+		if errors.Is(err, posix_mq.ErrClosed) {
+			return nil
+		}
+		var decodeErr *posix_mq.DecodeError
+		if errors.As(err, &decodeErr) {
+			s.logf("rpc: dropping request: %s", err)
+			continue
+		}
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			return err
+		}
+
+		//only the reply queues of the clients are written to, not any queue a request names
+		replyTo := req.Headers[headerReplyTo]
+		if req.Legacy || !strings.HasPrefix(replyTo, ReplyQueuePrefix(s.name)) {
+			s.logf("rpc: dropping request %q without a valid reply queue", req.ID)
+			continue
+		}
+		s.inflight.Add(1)
+		go func() {
+			defer s.inflight.Done()
+			s.handle(ctx, req, replyTo)
+		}()
+	}
+}
+
+func (s *Server) handle(ctx context.Context, req *posix_mq.Message, replyTo string) {
+	method := req.Headers[headerMethod]
+	if value, ok := req.Headers[headerDeadline]; ok {
+		deadline, ok := parseDeadline(value)
+		if ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, deadline)
+			defer cancel()
+		}
+		//the caller gave up already
+		if ctx.Err() != nil {
+			return
+		}
+	}
+
+	reply := &posix_mq.Message{
+		ContentType: req.ContentType,
+		TraceParent: req.TraceParent,
+		Headers:     map[string]string{headerCorrelationID: req.ID},
+		Priority:    req.Priority,
+	}
+	s.mu.RLock()
+	handler, ok := s.handlers[method]
+	s.mu.RUnlock()
+	if !ok {
+		reply.Headers[headerError] = "unknown method " + method
+		reply.Headers[headerErrorCode] = errorCodeUnknownMethod
+	} else if data, err := handler(ctx, req.Data); err != nil {
+		reply.Headers[headerError] = err.Error()
+	} else {
+		reply.Data = data
+	}
+
+	if err := s.reply(replyTo, reply); err != nil {
+		s.logf("rpc: replying to %s %q: %s", method, req.ID, err)
+	}
+}
+
+// reply sends the reply without waiting, a client that stopped reading does not hold up the server.
+// The reply queues are kept open until the server is closed; a queue whose name no longer refers to
+// the queue opened, because its client closed and maybe another one took the name, is opened again.
+func (s *Server) reply(replyTo string, reply *posix_mq.Message) error {
+	ino, err := queueInode(replyTo)
+	if err != nil {
+		return err
+	}
+	for {
+		s.replyMu.RLock()
+		if s.replies == nil {
+			s.replyMu.RUnlock()
+			//a handler still running when the server was closed
+			return sendReply(replyTo, reply)
+		}
+		if rq, ok := s.replies[replyTo]; ok && rq.ino == ino {
+			err := rq.queue.SendMessage(reply)
+			s.replyMu.RUnlock()
+			return err
+		}
+		s.replyMu.RUnlock()
+		if err := s.openReplyQueue(replyTo, ino); err != nil {
+			return err
+		}
+	}
+}
+
+// openReplyQueue opens the reply queue called name, whose inode is ino, unless it is open already.
+// The queues of the clients that are gone are closed at the same time, so that only the queues of
+// live clients are kept open.
+func (s *Server) openReplyQueue(name string, ino uint64) error {
+	s.replyMu.Lock()
+	defer s.replyMu.Unlock()
+	if rq, ok := s.replies[name]; s.replies == nil || ok && rq.ino == ino {
+		return nil
+	}
+	for other, rq := range s.replies {
+		if current, err := queueInode(other); err != nil || current != rq.ino {
+			rq.queue.Close()
+			delete(s.replies, other)
+		}
+	}
+	queue, err := posix_mq.NewMessageQueue(&posix_mq.QueueConfig{
+		Name:  name,
+		Flags: posix_mq.O_WRONLY | posix_mq.O_NONBLOCK,
+	})
+	if err != nil {
+		return err
+	}
+	s.replies[name] = replyQueue{queue: queue, ino: ino}
+	return nil
+}
+
+// sendReply opens the reply queue called replyTo just to send reply.
+func sendReply(replyTo string, reply *posix_mq.Message) error {
+	queue, err := posix_mq.NewMessageQueue(&posix_mq.QueueConfig{
+		Name:  replyTo,
+		Flags: posix_mq.O_WRONLY | posix_mq.O_NONBLOCK,
+	})
+	if err != nil {
+		return err
+	}
+	defer queue.Close()
+	return queue.SendMessage(reply)
+}
+
+// queueInode returns the inode of the queue called name, without opening it.
+func queueInode(name string) (uint64, error) {
+	fi, err := os.Stat(filepath.Join(posix_mq.POSIX_MQ_DIR, name))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Sys().(*syscall.Stat_t).Ino, nil
+}
+
+// Close closes the request queue, making Serve return once the running handlers are done, and the reply queues.
+// Closing a closed server does nothing.
+func (s *Server) Close() error {
+	err := s.queue.Close()
+	s.replyMu.Lock()
+	defer s.replyMu.Unlock()
+	for _, rq := range s.replies {
+		rq.queue.Close()
+	}
+	s.replies = nil
+	return err
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
@@ -0,0 +1,232 @@
+package posix_mq
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ShmMagic starts every reference to a shared memory segment sent by a ShmQueue.
+var ShmMagic = [4]byte{0x89, 'P', 'M', 'S'}
+
+const (
+	ShmVersion = 1
+
+	// SHM_DIR is where the segments are created by default.
+	SHM_DIR = "/dev/shm/"
+
+	// shmSegmentPrefix starts the name of the segments, followed by the queue name and a random suffix.
+	shmSegmentPrefix = "posix_mq."
+
+	// shmRefHeaderLen is the size of a reference before the segment name:
+	// magic, version, payload size and CRC-32C of the payload, the integers being big-endian.
+	shmRefHeaderLen = 4 + 1 + 8 + 4
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// ShmConfig is used to configure a ShmQueue, zero values meaning the defaults.
+type ShmConfig struct {
+	Threshold int    // Payloads larger than Threshold go to a segment, MaxMessageSize of the queue by default
+	Dir       string // Directory of the segments, SHM_DIR by default; the receiver must use the same
+	Mode      int    // The mode of the segments, 0600 by default
+}
+
+// ShmQueue sends large payloads through shared memory segments, the message queue only carrying a reference
+// to the segment holding the payload: its name, size and checksum. The receiver reads the payload and removes
+// the segment. Payloads up to Threshold and messages received without reference are carried as they are.
+//
+// The segments of messages that are never received are left behind, SweepSegments removes them.
+// A ShmQueue is safe for concurrent use by multiple goroutines.
+type ShmQueue struct {
+	mq     *MessageQueue
+	config ShmConfig
+}
+
+// NewShmQueue returns a ShmQueue over mq.
+func NewShmQueue(mq *MessageQueue, config *ShmConfig) *ShmQueue {
+	sq := &ShmQueue{mq: mq}
+	if config != nil {
+		sq.config = *config
+	}
+	if sq.config.Threshold <= 0 {
+		sq.config.Threshold = mq.msgSize
+	}
+	if sq.config.Dir == "" {
+		sq.config.Dir = SHM_DIR
+	}
+	if !strings.HasSuffix(sq.config.Dir, "/") {
+		sq.config.Dir += "/"
+	}
+	if sq.config.Mode == 0 {
+		sq.config.Mode = 0600
+	}
+	return sq
+}
+
+// Queue returns the underlying message queue.
+func (sq *ShmQueue) Queue() *MessageQueue {
+	return sq.mq
+}
+
+// Send sends data, through a segment when it is larger than Threshold.
+func (sq *ShmQueue) Send(data []byte, priority uint) error {
+	return sq.SendContext(context.Background(), data, priority)
+}
+
+// SendContext sends data, through a segment when it is larger than Threshold,
+// blocking until there is room on the queue or ctx is done.
+// The segment is removed again when the reference cannot be sent.
+func (sq *ShmQueue) SendContext(ctx context.Context, data []byte, priority uint) error {
+	if len(data) <= sq.config.Threshold {
+		return sq.mq.SendContext(ctx, data, priority)
+	}
+
+	var suffix [8]byte
+	rand.Read(suffix[:])
+	name := shmSegmentPrefix + sq.mq.name[1:] + "." + hex.EncodeToString(suffix[:])
+	path := sq.config.Dir + name
+	if err := writeSegment(path, data, os.FileMode(sq.config.Mode)); err != nil {
+		return sq.mq.opError("shm", err)
+	}
+
+	ref := make([]byte, shmRefHeaderLen, shmRefHeaderLen+len(name))
+	copy(ref, ShmMagic[:])
+	ref[4] = ShmVersion
+	binary.BigEndian.PutUint64(ref[5:], uint64(len(data)))
+	binary.BigEndian.PutUint32(ref[13:], crc32.Checksum(data, crc32c))
+	ref = append(ref, name...)
+	if err := sq.mq.SendContext(ctx, ref, priority); err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+func writeSegment(path string, data []byte, mode os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return pathError(err)
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return pathError(err)
+	}
+	return nil
+}
+
+// Receive receives a message, reading its payload from the segment it refers to, if any.
+// A reference to a segment that is missing or does not match its checksum fails with
+// a "decode" OpError wrapping a *DecodeError.
+func (sq *ShmQueue) Receive() ([]byte, uint, error) {
+	return sq.ReceiveContext(context.Background())
+}
+
+// ReceiveContext is Receive blocking until a message arrives or ctx is done.
+func (sq *ShmQueue) ReceiveContext(ctx context.Context) ([]byte, uint, error) {
+	msg, prio, err := sq.mq.ReceiveContext(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(msg) <= shmRefHeaderLen || [4]byte(msg[:4]) != ShmMagic || msg[4] != ShmVersion {
+		return msg, prio, nil
+	}
+	data, err := sq.readSegment(msg)
+	if err != nil {
+		return nil, prio, sq.mq.opError("decode", &DecodeError{Data: msg, Priority: prio, Err: err})
+	}
+	return data, prio, nil
+}
+
+// readSegment maps the segment ref refers to, copies the payload out and removes the segment.
+func (sq *ShmQueue) readSegment(ref []byte) ([]byte, error) {
+	size := binary.BigEndian.Uint64(ref[5:])
+	checksum := binary.BigEndian.Uint32(ref[13:])
+	name := string(ref[shmRefHeaderLen:])
+	//a reference only names segments of the queue in Dir
+	if !strings.HasPrefix(name, shmSegmentPrefix+sq.mq.name[1:]+".") || strings.Contains(name, "/") {
+		return nil, fmt.Errorf("invalid segment name %q", name)
+	}
+	path := sq.config.Dir + name
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, pathError(err)
+	}
+	defer os.Remove(path)
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, pathError(err)
+	}
+	if uint64(fi.Size()) != size {
+		return nil, fmt.Errorf("segment %s holds %d bytes, expected %d", name, fi.Size(), size)
+	}
+
+	data := make([]byte, size)
+	if size > 0 {
+		mapped, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+		if err != nil {
+			return nil, err
+		}
+		copy(data, mapped)
+		syscall.Munmap(mapped)
+	}
+	if crc32.Checksum(data, crc32c) != checksum {
+		return nil, fmt.Errorf("segment %s does not match its checksum", name)
+	}
+	return data, nil
+}
+
+// SweepSegments removes the segments in dir, SHM_DIR when empty, whose queue does not exist anymore
+// or which were created more than maxAge ago, and returns the number of segments removed.
+// maxAge should exceed the time a message may wait in its queue, as the payload of a message
+// received after its segment was swept is lost.
+func SweepSegments(dir string, maxAge time.Duration) (int, error) {
+	if dir == "" {
+		dir = SHM_DIR
+	}
+	dir = strings.TrimSuffix(dir, "/") + "/"
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, &OpError{Op: "sweep", Name: dir, Err: pathError(err)}
+	}
+	removed := 0
+	for _, entry := range entries {
+		rest, ok := strings.CutPrefix(entry.Name(), shmSegmentPrefix)
+		if !ok {
+			continue
+		}
+		dot := strings.LastIndexByte(rest, '.')
+		if dot <= 0 {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		//os.Stat does not open the queue file, whose closing would drop the Notify registrations of this process
+		if _, err := os.Stat(POSIX_MQ_DIR + rest[:dot]); !errors.Is(err, fs.ErrNotExist) && time.Since(info.ModTime()) <= maxAge {
+			continue
+		}
+		if err := os.Remove(dir + entry.Name()); err == nil {
+			removed++
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return removed, &OpError{Op: "sweep", Name: dir + entry.Name(), Err: pathError(err)}
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,123 @@
+package posix_mq
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// TTLMagic starts the header of the messages sent by SendWithTTL, which holds the deadline of the message.
+var TTLMagic = [4]byte{0x89, 'P', 'M', 'T'}
+
+const (
+	TTLVersion = 1
+
+	// ttlHeaderLen is the size of the header of a message with a deadline:
+	// magic, version and deadline in Unix nanoseconds, big-endian.
+	ttlHeaderLen = 4 + 1 + 8
+)
+
+// SendWithTTL sends data with a deadline ttl from now. The receive calls of a queue opened with QueueConfig.TTL
+// strip the deadline off, and discard the message once it has passed, counting it in Expired and handing it
+// to the sink set with SetExpiredSink; other queues receive the message with its deadline, as sent. The deadline takes 13 bytes of the message, so data must leave room for it
+// within MaxMessageSize. The clocks of the sender and the receiver are assumed to agree.
+// Expired messages still count in Count until a receive call discards them.
+func (mq *MessageQueue) SendWithTTL(data []byte, priority uint, ttl time.Duration) error {
+	return mq.SendWithTTLContext(context.Background(), data, priority, ttl)
+}
+
+// SendWithTTLContext is SendWithTTL blocking until there is room on the queue or ctx is done.
+// Time spent waiting for room counts against ttl.
+func (mq *MessageQueue) SendWithTTLContext(ctx context.Context, data []byte, priority uint, ttl time.Duration) error {
+	msg, err := withTTL(data, ttl)
+	if err != nil {
+		return mq.opError("send", err)
+	}
+	return mq.SendContext(ctx, msg, priority)
+}
+
+// Expired returns the number of messages discarded so far by the receive calls because their deadline had passed.
+func (mq *MessageQueue) Expired() uint64 {
+	return mq.expiry.count.Load()
+}
+
+// SetExpiredSink has the messages discarded because their deadline had passed handed to sink,
+// without their deadline. SinkFunc turns a callback into a sink. The errors of sink are ignored,
+// the receive call going on with the next message. A nil sink removes the sink.
+func (mq *MessageQueue) SetExpiredSink(sink MessageSink) {
+	mq.expiry.setSink(sink)
+}
+
+// SendWithTTL is MessageQueue.SendWithTTL, the receive calls of a MemoryQueue opened with QueueConfig.TTL
+// discarding the message once its deadline has passed.
+func (mq *MemoryQueue) SendWithTTL(data []byte, priority uint, ttl time.Duration) error {
+	return mq.SendWithTTLContext(context.Background(), data, priority, ttl)
+}
+
+// SendWithTTLContext is SendWithTTL blocking until there is room on the queue or ctx is done.
+func (mq *MemoryQueue) SendWithTTLContext(ctx context.Context, data []byte, priority uint, ttl time.Duration) error {
+	msg, err := withTTL(data, ttl)
+	if err != nil {
+		return mq.opError("send", err)
+	}
+	return mq.SendContext(ctx, msg, priority)
+}
+
+// Expired returns the number of messages discarded so far by the receive calls because their deadline had passed.
+func (mq *MemoryQueue) Expired() uint64 {
+	return mq.expiry.count.Load()
+}
+
+// SetExpiredSink is MessageQueue.SetExpiredSink.
+func (mq *MemoryQueue) SetExpiredSink(sink MessageSink) {
+	mq.expiry.setSink(sink)
+}
+
+// withTTL returns data behind the header holding a deadline ttl from now.
+func withTTL(data []byte, ttl time.Duration) ([]byte, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("invalid ttl %s: %w", ttl, syscall.EINVAL)
+	}
+	msg := make([]byte, ttlHeaderLen, ttlHeaderLen+len(data))
+	copy(msg, TTLMagic[:])
+	msg[4] = TTLVersion
+	binary.BigEndian.PutUint64(msg[5:], uint64(time.Now().Add(ttl).UnixNano()))
+	return append(msg, data...), nil
+}
+
+// expiry keeps track of the messages a queue discarded because their deadline had passed.
+type expiry struct {
+	enabled bool // QueueConfig.TTL, set once when the queue is opened
+	count   atomic.Uint64
+	sink    atomic.Pointer[MessageSink]
+}
+
+func (e *expiry) setSink(sink MessageSink) {
+	if sink == nil {
+		e.sink.Store(nil)
+		return
+	}
+	e.sink.Store(&sink)
+}
+
+// strip strips the deadline off the received message msg, moving the payload to the start of msg,
+// and returns the size of the payload. It returns false when the deadline has passed, the message being discarded.
+// Messages without deadline are left as they are, as are all messages unless e is enabled.
+func (e *expiry) strip(msg []byte, prio uint) (int, bool) {
+	if !e.enabled || len(msg) < ttlHeaderLen || [4]byte(msg[:4]) != TTLMagic || msg[4] != TTLVersion {
+		return len(msg), true
+	}
+	deadline := int64(binary.BigEndian.Uint64(msg[5:]))
+	size := copy(msg, msg[ttlHeaderLen:])
+	if time.Now().UnixNano() < deadline {
+		return size, true
+	}
+	e.count.Add(1)
+	if sink := e.sink.Load(); sink != nil {
+		(*sink).WriteMessage(msg[:size], prio)
+	}
+	return 0, false
+}
@@ -0,0 +1,128 @@
+package posix_mq
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// TypedQueue sends and receives values of type T over a MessageQueue, converting them with a Codec.
+// A TypedQueue is safe for concurrent use by multiple goroutines, as long as its Codec is.
+type TypedQueue[T any] struct {
+	mq    *MessageQueue
+	codec Codec[T]
+}
+
+// DecodeError is returned when a received message cannot be decoded.
+// The message is consumed from the queue nonetheless, it is kept in Data so it can be inspected or sent elsewhere.
+type DecodeError struct {
+	Data     []byte
+	Priority uint
+	Err      error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("decoding %d bytes message: %s", len(e.Data), e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// NewTypedQueue returns a TypedQueue carrying values of type T over mq.
+func NewTypedQueue[T any](mq *MessageQueue, codec Codec[T]) *TypedQueue[T] {
+	return &TypedQueue[T]{mq: mq, codec: codec}
+}
+
+// Queue returns the underlying message queue.
+func (q *TypedQueue[T]) Queue() *MessageQueue {
+	return q.mq
+}
+
+// Send encodes v and sends it to the message queue.
+// A value encoded into more than MaxMessageSize bytes fails with an "encode" OpError matching ErrMessageTooLarge.
+func (q *TypedQueue[T]) Send(v T, priority uint) error {
+	return q.SendContext(context.Background(), v, priority)
+}
+
+// TimedSend encodes v and sends it to the message queue with a ceiling on the time for which the call will block.
+func (q *TypedQueue[T]) TimedSend(v T, priority uint, duration time.Duration) error {
+	data, err := q.encode(v)
+	if err != nil {
+		return err
+	}
+	return q.mq.TimedSend(data, priority, duration)
+}
+
+// SendContext encodes v and sends it to the message queue, blocking until there is room on the queue or ctx is done.
+func (q *TypedQueue[T]) SendContext(ctx context.Context, v T, priority uint) error {
+	data, err := q.encode(v)
+	if err != nil {
+		return err
+	}
+	return q.mq.SendContext(ctx, data, priority)
+}
+
+func (q *TypedQueue[T]) encode(v T) ([]byte, error) {
+	data, err := q.codec.Encode(v)
+	if err != nil {
+		return nil, q.mq.opError("encode", err)
+	}
+	//rejected before sending, so the error tells the encoded size
+	if len(data) > q.mq.msgSize {
+		return nil, q.mq.opError("encode", fmt.Errorf("%d bytes encoded, the queue takes %d: %w", len(data), q.mq.msgSize, syscall.EMSGSIZE))
+	}
+	return data, nil
+}
+
+// Receive receives a message from the message queue and decodes it.
+// A message that cannot be decoded fails with a "decode" OpError wrapping a *DecodeError,
+// any other error comes from the queue itself.
+func (q *TypedQueue[T]) Receive() (T, uint, error) {
+	return q.receive(context.Background(), nil)
+}
+
+// TimedReceive receives a message from the message queue with a ceiling on the time for which the call will block,
+// and decodes it.
+func (q *TypedQueue[T]) TimedReceive(duration time.Duration) (T, uint, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+	return q.receive(ctx, timedOut)
+}
+
+// ReceiveContext receives a message from the message queue, blocking until a message arrives or ctx is done,
+// and decodes it.
+func (q *TypedQueue[T]) ReceiveContext(ctx context.Context) (T, uint, error) {
+	if err := ctx.Err(); err != nil {
+		var zero T
+		return zero, 0, q.mq.opError("receive", err)
+	}
+	return q.receive(ctx, nil)
+}
+
+// receive receives and decodes a message, passing the error of the queue through mapErr when it is set.
+func (q *TypedQueue[T]) receive(ctx context.Context, mapErr func(error) error) (T, uint, error) {
+	var v T
+	buf := q.mq.recvBufs.Get().(*[]byte)
+	defer q.mq.recvBufs.Put(buf)
+
+	//decoding straight from the receive buffer, the message is only copied when it fails to decode
+	size, prio, err := q.mq.receiveInto(ctx, *buf)
+	if err != nil {
+		if mapErr != nil {
+			err = mapErr(err)
+		}
+		return v, 0, q.mq.opError("receive", err)
+	}
+	if err := q.codec.Decode((*buf)[:size], &v); err != nil {
+		data := append([]byte{}, (*buf)[:size]...)
+		return v, prio, q.mq.opError("decode", &DecodeError{Data: data, Priority: prio, Err: err})
+	}
+	return v, prio, nil
+}
+
+// Close closes the underlying message queue.
+func (q *TypedQueue[T]) Close() error {
+	return q.mq.Close()
+}
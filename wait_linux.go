@@ -0,0 +1,70 @@
+package posix_mq
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// waiter is a call of await waiting on an epoll instance of its own, whose deadline is the earliest of
+// the deadline of the context of the call and the deadline of the queue, see MessageQueue.SetDeadline.
+// Its fields other than file and write are guarded by MessageQueue.deadlineMu.
+type waiter struct {
+	file        *os.File
+	write       bool
+	ctxDeadline time.Time
+	byQueue     bool // whether the deadline of file is that of the queue
+	woken       bool // the context is done or the queue closed, file has a deadline in the past for good
+}
+
+// setDeadline gives w the earliest of its context deadline and the queue deadline d, unless it was woken up.
+func (w *waiter) setDeadline(d time.Time) {
+	if w.woken {
+		return
+	}
+	w.byQueue = !d.IsZero() && (w.ctxDeadline.IsZero() || d.Before(w.ctxDeadline))
+	if w.byQueue {
+		w.file.SetDeadline(d)
+	} else {
+		w.file.SetDeadline(w.ctxDeadline)
+	}
+}
+
+// openWaiter returns an epoll instance watching the queue descriptor fd for reading, or for writing when write is set.
+// It is registered with the runtime poller like the queue is, but with deadlines of its own,
+// and closing it leaves the queue descriptor and its mq_notify registration alone.
+func openWaiter(fd int, write bool) (*os.File, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	event := &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)}
+	if write {
+		event.Events = syscall.EPOLLOUT
+	}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fd, event); err != nil {
+		syscall.Close(epfd)
+		return nil, err
+	}
+	//a non-blocking descriptor is what makes os.NewFile register it with the poller
+	if err := syscall.SetNonblock(epfd, true); err != nil {
+		syscall.Close(epfd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(epfd), "mq_wait"), nil
+}
+
+// waitReady parks the goroutine until the queue watched by waiter is ready.
+// Only the wait happens on waiter, the operation itself is retried on the shared descriptor.
+func waitReady(waiter *os.File) error {
+	conn, err := waiter.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var events [1]syscall.EpollEvent
+	return conn.Read(func(fd uintptr) bool {
+		//the level-triggered watch reports the queue as long as it is ready
+		n, err := syscall.EpollWait(int(fd), events[:], 0)
+		return n > 0 || (err != nil && err != syscall.EINTR)
+	})
+}
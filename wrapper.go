@@ -1,7 +1,14 @@
+//go:build cgo && !purego
+
 package posix_mq
 
 /*
 #cgo LDFLAGS: -lrt
+// Keep the arguments of the hot path on the Go stack, C does not retain them (needs Go 1.24).
+#cgo noescape mq_send
+#cgo noescape mq_receive
+#cgo nocallback mq_send
+#cgo nocallback mq_receive
 
 #include <stdlib.h>
 #include <signal.h>
@@ -15,8 +22,6 @@ mqd_t mq_open4(const char *name, int oflag, int mode, struct mq_attr *attr) {
 */
 import "C"
 import (
-	"fmt"
-	"time"
 	"unsafe"
 )
 
@@ -30,43 +35,11 @@ const (
 	O_EXCL     = C.O_EXCL
 	O_NONBLOCK = C.O_NONBLOCK
 
-	// Based on Linux 3.5+
+	// Based on Linux 3.5+, the limits in effect are reported by SystemLimits
 	MSGSIZE_MAX     = 16777216
 	MSGSIZE_DEFAULT = MSGSIZE_MAX
 )
 
-var (
-	MemoryAllocationError = fmt.Errorf("Memory Allocation Error")
-)
-
-type receiveBuffer struct {
-	buf  *C.char
-	size C.size_t
-}
-
-func newReceiveBuffer(bufSize int) (*receiveBuffer, error) {
-	buf := (*C.char)(C.malloc(C.size_t(bufSize)))
-	if buf == nil {
-		return nil, MemoryAllocationError
-	}
-
-	return &receiveBuffer{
-		buf:  buf,
-		size: C.size_t(bufSize),
-	}, nil
-}
-
-func (rb *receiveBuffer) free() {
-	C.free(unsafe.Pointer(rb.buf))
-}
-
-func timeToTimespec(t time.Time) C.struct_timespec {
-	return C.struct_timespec{
-		tv_sec:  C.long(t.Unix()),
-		tv_nsec: C.long(t.Nanosecond() % 1000000000),
-	}
-}
-
 func mq_open(name string, oflag int, mode int, attr *MessageQueueAttribute) (int, error) {
 	var cAttr *C.struct_mq_attr
 	if attr != nil {
@@ -88,24 +61,7 @@ func mq_open(name string, oflag int, mode int, attr *MessageQueueAttribute) (int
 }
 
 func mq_send(h int, data []byte, priority uint) error {
-	byteStr := *(*string)(unsafe.Pointer(&data))
-	cStr := C.CString(byteStr)
-	defer C.free(unsafe.Pointer(cStr))
-	rv, err := C.mq_send(C.int(h), cStr, C.size_t(len(data)), C.uint(priority))
-	if rv == -1 {
-		return err
-	}
-
-	return nil
-}
-
-func mq_timedsend(h int, data []byte, priority uint, t time.Time) error {
-	timeSpec := timeToTimespec(t)
-
-	byteStr := *(*string)(unsafe.Pointer(&data))
-	cStr := C.CString(byteStr)
-	defer C.free(unsafe.Pointer(cStr))
-	rv, err := C.mq_timedsend(C.int(h), cStr, C.size_t(len(data)), C.uint(priority), &timeSpec)
+	rv, err := C.mq_send(C.int(h), (*C.char)(unsafe.Pointer(unsafe.SliceData(data))), C.size_t(len(data)), C.uint(priority))
 	if rv == -1 {
 		return err
 	}
@@ -113,34 +69,20 @@ func mq_timedsend(h int, data []byte, priority uint, t time.Time) error {
 	return nil
 }
 
-func mq_receive(h int, recvBuf *receiveBuffer) ([]byte, uint, error) {
+func mq_receive(h int, buf []byte) (int, uint, error) {
 	var msgPrio C.uint
 
-	size, err := C.mq_receive(C.int(h), recvBuf.buf, recvBuf.size, &msgPrio)
+	size, err := C.mq_receive(C.int(h), (*C.char)(unsafe.Pointer(unsafe.SliceData(buf))), C.size_t(len(buf)), &msgPrio)
 	if size == -1 {
-		return nil, 0, err
+		return 0, 0, err
 	}
 
-	return C.GoBytes(unsafe.Pointer(recvBuf.buf), C.int(size)), uint(msgPrio), nil
-}
-
-func mq_timedreceive(h int, recvBuf *receiveBuffer, t time.Time) ([]byte, uint, error) {
-	var (
-		msgPrio  C.uint
-		timeSpec = timeToTimespec(t)
-	)
-
-	size, err := C.mq_timedreceive(C.int(h), recvBuf.buf, recvBuf.size, &msgPrio, &timeSpec)
-	if size == -1 {
-		return nil, 0, err
-	}
-
-	return C.GoBytes(unsafe.Pointer(recvBuf.buf), C.int(size)), uint(msgPrio), nil
+	return int(size), uint(msgPrio), nil
 }
 
 func mq_notify(h int, sigNo int) error {
 	sigEvent := &C.struct_sigevent{
-		sigev_notify: C.SIGEV_SIGNAL, // posix_mq supports only signal.
+		sigev_notify: C.SIGEV_SIGNAL, // NotifyChan and NotifyFunc register SIGEV_THREAD themselves.
 		sigev_signo:  C.int(sigNo),
 	}
 
@@ -152,15 +94,6 @@ func mq_notify(h int, sigNo int) error {
 	return nil
 }
 
-func mq_close(h int) error {
-	rv, err := C.mq_close(C.int(h))
-	if rv == -1 {
-		return err
-	}
-
-	return nil
-}
-
 func mq_unlink(name string) error {
 	cStr := C.CString(name)
 	defer C.free(unsafe.Pointer(cStr))
@@ -188,3 +121,23 @@ func mq_getattr(h int) (*MessageQueueAttribute, error) {
 
 	return mqa, nil
 }
+
+func mq_setattr(h int, attr *MessageQueueAttribute) (*MessageQueueAttribute, error) {
+	cAttr := C.struct_mq_attr{
+		mq_flags: C.long(attr.Flags),
+	}
+	var cOldAttr C.struct_mq_attr
+	rv, err := C.mq_setattr(C.int(h), &cAttr, &cOldAttr)
+	if rv == -1 {
+		return nil, err
+	}
+
+	mqa := &MessageQueueAttribute{
+		Flags:   int(cOldAttr.mq_flags),
+		MaxMsg:  int(cOldAttr.mq_maxmsg),
+		MsgSize: int(cOldAttr.mq_msgsize),
+		MsgCnt:  int(cOldAttr.mq_curmsgs),
+	}
+
+	return mqa, nil
+}
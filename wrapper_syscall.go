@@ -0,0 +1,151 @@
+//go:build linux && (!cgo || purego)
+
+package posix_mq
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// This backend calls the Linux message queue system calls directly, without cgo or librt.
+// It is used when cgo is disabled or the purego build tag is set.
+
+const (
+	O_RDONLY = syscall.O_RDONLY
+	O_WRONLY = syscall.O_WRONLY
+	O_RDWR   = syscall.O_RDWR
+
+	O_CLOEXEC  = syscall.O_CLOEXEC
+	O_CREAT    = syscall.O_CREAT
+	O_EXCL     = syscall.O_EXCL
+	O_NONBLOCK = syscall.O_NONBLOCK
+
+	// Based on Linux 3.5+, the limits in effect are reported by SystemLimits
+	MSGSIZE_MAX     = 16777216
+	MSGSIZE_DEFAULT = MSGSIZE_MAX
+)
+
+// mqAttr mirrors struct mq_attr, where every field is a C long.
+type mqAttr struct {
+	flags   int
+	maxmsg  int
+	msgsize int
+	curmsgs int
+	_       [4]int
+}
+
+// kernelName validates name the way glibc does and strips the leading slash the syscalls do not expect.
+func kernelName(name string) (*byte, error) {
+	if len(name) == 0 || name[0] != '/' {
+		return nil, syscall.EINVAL
+	}
+	return syscall.BytePtrFromString(name[1:])
+}
+
+func mq_open(name string, oflag int, mode int, attr *MessageQueueAttribute) (int, error) {
+	var kAttr *mqAttr
+	if attr != nil {
+		kAttr = &mqAttr{
+			flags:   attr.Flags,
+			maxmsg:  attr.MaxMsg,
+			msgsize: attr.MsgSize,
+			curmsgs: attr.MsgCnt,
+		}
+	}
+	kName, err := kernelName(name)
+	if err != nil {
+		return 0, err
+	}
+	h, _, errno := syscall.Syscall6(syscall.SYS_MQ_OPEN, uintptr(unsafe.Pointer(kName)), uintptr(oflag), uintptr(mode), uintptr(unsafe.Pointer(kAttr)), 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+
+	return int(h), nil
+}
+
+// mq_send is mq_timedsend without a timeout, as in glibc.
+func mq_send(h int, data []byte, priority uint) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_MQ_TIMEDSEND, uintptr(h), uintptr(unsafe.Pointer(unsafe.SliceData(data))), uintptr(len(data)), uintptr(priority), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// mq_receive is mq_timedreceive without a timeout, as in glibc.
+func mq_receive(h int, buf []byte) (int, uint, error) {
+	var msgPrio uint32
+
+	size, _, errno := syscall.Syscall6(syscall.SYS_MQ_TIMEDRECEIVE, uintptr(h), uintptr(unsafe.Pointer(unsafe.SliceData(buf))), uintptr(len(buf)), uintptr(unsafe.Pointer(&msgPrio)), 0, 0)
+	if errno != 0 {
+		return 0, 0, errno
+	}
+
+	return int(size), uint(msgPrio), nil
+}
+
+func mq_notify(h int, sigNo int) error {
+	sigEvent := &sigevent{
+		signo:  int32(sigNo),
+		notify: sigevSignal, // NotifyChan and NotifyFunc register SIGEV_THREAD themselves.
+	}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_MQ_NOTIFY, uintptr(h), uintptr(unsafe.Pointer(sigEvent)), 0)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+func mq_unlink(name string) error {
+	kName, err := kernelName(name)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_MQ_UNLINK, uintptr(unsafe.Pointer(kName)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+func mq_getattr(h int) (*MessageQueueAttribute, error) {
+	var kAttr mqAttr
+	_, _, errno := syscall.Syscall(syscall.SYS_MQ_GETSETATTR, uintptr(h), 0, uintptr(unsafe.Pointer(&kAttr)))
+	if errno != 0 {
+		return nil, errno
+	}
+
+	mqa := &MessageQueueAttribute{
+		Flags:   kAttr.flags,
+		MaxMsg:  kAttr.maxmsg,
+		MsgSize: kAttr.msgsize,
+		MsgCnt:  kAttr.curmsgs,
+	}
+
+	return mqa, nil
+}
+
+func mq_setattr(h int, attr *MessageQueueAttribute) (*MessageQueueAttribute, error) {
+	kAttr := mqAttr{
+		flags: attr.Flags,
+	}
+	var kOldAttr mqAttr
+	_, _, errno := syscall.Syscall(syscall.SYS_MQ_GETSETATTR, uintptr(h), uintptr(unsafe.Pointer(&kAttr)), uintptr(unsafe.Pointer(&kOldAttr)))
+	if errno != 0 {
+		return nil, errno
+	}
+
+	mqa := &MessageQueueAttribute{
+		Flags:   kOldAttr.flags,
+		MaxMsg:  kOldAttr.maxmsg,
+		MsgSize: kOldAttr.msgsize,
+		MsgCnt:  kOldAttr.curmsgs,
+	}
+
+	return mqa, nil
+}